@@ -0,0 +1,183 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"io/ioutil"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// BlobStore stores file contents that are too large to be kept in
+	// the datastore, such as Google Cloud Storage
+	BlobStore interface {
+		// Create returns a writer for a new blob with the given name, the
+		// blob must not be visible to Open until the writer is closed
+		Create(ctx context.Context, name string) (io.WriteCloser, error)
+
+		// Open returns a reader for the named blob
+		Open(ctx context.Context, name string) (io.ReadCloser, error)
+
+		// Delete removes the named blob, it is not an error if the
+		// blob does not exist
+		Delete(ctx context.Context, name string) error
+	}
+
+	// localBlobStore implements BlobStore using a local directory
+	localBlobStore struct {
+		dir string
+	}
+
+	// localBlobWriter writes to a temporary file which is renamed to the
+	// blob name when closed
+	localBlobWriter struct {
+		*os.File
+		name string
+	}
+)
+
+var (
+	ErrNoBlobStore      = errors.New("No blob store")
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+)
+
+// WithBlobStore stores the data for files larger than threshold bytes in
+// the blob store with the file entity only keeping a reference to it. If
+// the threshold is 0 files too large for a single entity are stored in
+// the blob store.
+func WithBlobStore(store BlobStore, threshold int64) Option {
+	return func(fs *FileSystem) {
+		if threshold <= 0 {
+			threshold = maxChunkSize
+		}
+		fs.blobs = store
+		fs.blobThreshold = threshold
+	}
+}
+
+// NewLocalBlobStore creates a BlobStore that saves blobs as files in dir
+func NewLocalBlobStore(dir string) BlobStore {
+	return &localBlobStore{dir: dir}
+}
+
+func (s *localBlobStore) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	filename := s.filename(name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".blob")
+	if err != nil {
+		return nil, err
+	}
+	return &localBlobWriter{File: f, name: filename}, nil
+}
+
+func (s *localBlobStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.filename(name))
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.filename(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlobStore) filename(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (w *localBlobWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.name)
+}
+
+// useBlob returns whether data should be stored in the blob store
+func (fs *FileSystem) useBlob(data []byte) bool {
+	return fs.blobs != nil && int64(len(data)) > fs.blobThreshold
+}
+
+// writeBlob saves the data to a new blob, returning its name and checksum
+func (fs *FileSystem) writeBlob(data []byte) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	name := path.Join(fs.namespace, fs.kind, hex.EncodeToString(id))
+
+	w, err := fs.blobs.Create(fs.ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		fs.deleteBlobs(name)
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		fs.deleteBlobs(name)
+		return "", "", err
+	}
+
+	return name, checksum(data), nil
+}
+
+// readBlob streams the encoded data from the blob store, checking that
+// it matches the checksum recorded in the entity referencing it
+func (fs *FileSystem) readBlob(name, sum string) ([]byte, error) {
+	if fs.blobs == nil {
+		return nil, ErrNoBlobStore
+	}
+
+	r, err := fs.blobs.Open(fs.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, io.TeeReader(r, h)); err != nil {
+		return nil, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return nil, ErrChecksumMismatch
+	}
+	return buf.Bytes(), nil
+}
+
+// deleteBlobs removes blobs that are no longer referenced, failures are
+// only logged as the file entities have already been updated
+func (fs *FileSystem) deleteBlobs(names ...string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if fs.blobs == nil {
+			fs.log.Error("delete blob", "blob", name, "error", ErrNoBlobStore)
+			continue
+		}
+		if err := fs.blobs.Delete(fs.ctx, name); err != nil {
+			fs.log.Error("delete blob", "blob", name, "error", err)
+		}
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
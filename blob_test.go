@@ -0,0 +1,116 @@
+package dfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func countBlobs(t *testing.T, dir string) int {
+	count := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestBlobStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dfs-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver := NewMemoryDriver()
+	blobs := NewLocalBlobStore(dir)
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithBlobStore(blobs, 1024))
+
+	data := bytes.Repeat([]byte("0123456789"), maxChunkSize*2)
+	if err := afero.WriteFile(fs, "/dir/large.bin", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/dir/small.txt", []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, dir); n != 1 {
+		t.Errorf("blobs = %d, want 1", n)
+	}
+
+	// the entity only keeps the reference
+	var fileData FileData
+	if err := driver.Get(ctx, fs.makeKey("/dir/large.bin"), &fileData); err != nil {
+		t.Fatal(err)
+	}
+	if fileData.Blob == "" || len(fileData.Data) != 0 || fileData.Size != int64(len(data)) {
+		t.Errorf("blob = %q, data = %d, size = %d", fileData.Blob, len(fileData.Data), fileData.Size)
+	}
+
+	fs = NewDriverFileSystem(ctx, driver, "", "", WithBlobStore(blobs, 1024))
+	if err := fs.Rename("/dir/large.bin", "/dir/moved.bin"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := afero.ReadFile(fs, "/dir/moved.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("blob data does not match")
+	}
+
+	// overwriting with a small file deletes the blob
+	if err := afero.WriteFile(fs, "/dir/moved.bin", []byte("now small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, dir); n != 0 {
+		t.Errorf("blobs after overwrite = %d, want 0", n)
+	}
+
+	afero.WriteFile(fs, "/dir/a.bin", data, 0644)
+	afero.WriteFile(fs, "/dir/b.bin", data, 0644)
+	if err := fs.Remove("/dir/a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, dir); n != 1 {
+		t.Errorf("blobs after remove = %d, want 1", n)
+	}
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, dir); n != 0 {
+		t.Errorf("blobs after remove all = %d, want 0", n)
+	}
+}
+
+func TestBlobChecksum(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dfs-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithBlobStore(NewLocalBlobStore(dir), 4))
+	if err := afero.WriteFile(fs, "/file.txt", []byte("blob content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var fileData FileData
+	driver.Get(ctx, fs.makeKey("/file.txt"), &fileData)
+	ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(fileData.Blob)), []byte("blob CONTENT"), 0600)
+
+	fs = NewDriverFileSystem(ctx, driver, "", "", WithBlobStore(NewLocalBlobStore(dir), 4))
+	if _, err := fs.Open("/file.txt"); err == nil || err.(*os.PathError).Err != ErrChecksumMismatch {
+		t.Errorf("err = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
@@ -0,0 +1,342 @@
+package dfs
+
+import (
+	"strings"
+	"sync"
+
+	"container/list"
+	"path/filepath"
+)
+
+type (
+	// CacheStats are the counters of the session cache
+	CacheStats struct {
+		Hits      int64
+		Misses    int64
+		Evictions int64
+		Entries   int
+		Bytes     int64
+	}
+
+	// fileCache is the session cache of FileData by name. Once it is over
+	// budget the least recently used entries are evicted, except for those
+	// that are dirty or have open file handles which are pinned. The cache
+	// never takes the lock of any file data, so a slow save can't hold up
+	// lookups, and reads the size, dirty flag and handle count it needs
+	// from the atomics the file data publishes them in.
+	fileCache struct {
+		sync.Mutex
+		maxEntries int
+		maxBytes   int64
+		entries    map[string]*list.Element
+		lru        *list.List
+		loading    map[string]chan struct{}
+		stats      CacheStats
+	}
+
+	// cacheEntry is an element of the cache LRU list
+	cacheEntry struct {
+		name     string
+		fileData *FileData
+		size     int64
+	}
+)
+
+const (
+	// DefaultCacheEntries is the default limit on the number of files in
+	// the session cache, 0 means there is no limit
+	DefaultCacheEntries = 0
+
+	// DefaultCacheBytes is the default limit on the size of the file data
+	// in the session cache
+	DefaultCacheBytes = 32 << 20
+)
+
+// WithCacheLimit sets the budget for the session cache, the number of
+// files and total size of their data it holds. A limit of 0 is unlimited.
+func WithCacheLimit(entries int, bytes int64) Option {
+	return func(fs *FileSystem) {
+		fs.cache.maxEntries = entries
+		fs.cache.maxBytes = bytes
+	}
+}
+
+// CacheStats returns the counters of the session cache
+func (fs *FileSystem) CacheStats() CacheStats {
+	return fs.cache.Stats()
+}
+
+func newFileCache(maxEntries int, maxBytes int64) *fileCache {
+	return &fileCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		loading:    make(map[string]chan struct{}),
+	}
+}
+
+// get returns the cached file data, marking it as most recently used. If
+// pin is set a file handle is counted so it can't be evicted.
+func (c *fileCache) get(name string, pin bool) (*FileData, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*cacheEntry)
+	c.resize(entry)
+	if pin {
+		c.pin(entry.fileData)
+	}
+	return entry.fileData, true
+}
+
+// add adds the file data to the cache, replacing any existing entry, and
+// evicts entries if the cache is then over budget
+func (c *fileCache) add(name string, fileData *FileData) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[name]; ok {
+		c.removeElement(e)
+	}
+	entry := &cacheEntry{name: name, fileData: fileData}
+	c.entries[name] = c.lru.PushFront(entry)
+	c.stats.Entries++
+	c.resize(entry)
+	c.trim()
+}
+
+// load returns the cached file data, calling load to add it if it isn't
+// in the cache, and pins it like get. Concurrent calls for the same file
+// wait for the first to load it so they share the same file data, rather
+// than one replacing the other with a copy that may have been loaded
+// before the other was saved.
+func (c *fileCache) load(name string, pin bool, load func() (*FileData, error)) (*FileData, error) {
+	c.Lock()
+	for {
+		if e, ok := c.entries[name]; ok {
+			c.lru.MoveToFront(e)
+			fileData := e.Value.(*cacheEntry).fileData
+			if pin {
+				c.pin(fileData)
+			}
+			c.Unlock()
+			return fileData, nil
+		}
+		done, ok := c.loading[name]
+		if !ok {
+			break
+		}
+
+		// the loaded file is looked up again in case it was evicted and
+		// the error may be from the context of the other caller
+		c.Unlock()
+		<-done
+		c.Lock()
+	}
+
+	done := make(chan struct{})
+	c.loading[name] = done
+	c.Unlock()
+
+	fileData, err := load()
+
+	c.Lock()
+	delete(c.loading, name)
+	if e, ok := c.entries[name]; ok && err == nil {
+		// a new file was added while it was loading
+		fileData = e.Value.(*cacheEntry).fileData
+	} else if err == nil {
+		entry := &cacheEntry{name: name, fileData: fileData}
+		c.entries[name] = c.lru.PushFront(entry)
+		c.stats.Entries++
+		c.resize(entry)
+	}
+	if err == nil && pin {
+		c.pin(fileData)
+	}
+	c.trim()
+	c.Unlock()
+	close(done)
+
+	return fileData, err
+}
+
+// pin counts a file handle for the file data while the cache is locked
+func (c *fileCache) pin(fileData *FileData) {
+	fileData.handles.Add(1)
+}
+
+// release is called when a file handle is closed so the file data can be
+// measured again and the cache trimmed now it may no longer be pinned
+func (c *fileCache) release(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[name]; ok {
+		c.resize(e.Value.(*cacheEntry))
+	}
+	c.trim()
+}
+
+// remove removes the named file from the cache
+func (c *fileCache) remove(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[name]; ok {
+		c.removeElement(e)
+	}
+}
+
+// removeAll removes the named file and everything below it from the cache,
+// returning the file data that was removed
+func (c *fileCache) removeAll(name string) []*FileData {
+	c.Lock()
+	defer c.Unlock()
+
+	var removed []*FileData
+	prefix := subtreePrefix(name)
+	for n, e := range c.entries {
+		if n == name || strings.HasPrefix(n, prefix) {
+			removed = append(removed, e.Value.(*cacheEntry).fileData)
+			c.removeElement(e)
+		}
+	}
+	return removed
+}
+
+// hasDescendants returns whether any files below the named directory are
+// in the cache
+func (c *fileCache) hasDescendants(name string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	prefix := subtreePrefix(name)
+	for n := range c.entries {
+		if strings.HasPrefix(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rename moves the cached files at and below the old name to the new one,
+// replacing any at the new name. The generation of a cached file that was
+// loaded before it was renamed is updated to the generation after.
+func (c *fileCache) rename(oldname, newname string, loaded, generation int64) {
+	moved := c.move(oldname, newname)
+
+	// the file data is updated once the cache is unlocked
+	for _, entry := range moved {
+		entry.fileData.Lock()
+		entry.fileData.name = entry.name
+		entry.fileData.Parent = filepath.Dir(entry.name)
+		if entry.name == newname && entry.fileData.Generation == loaded {
+			entry.fileData.Generation = generation
+		}
+		entry.fileData.Unlock()
+	}
+}
+
+// move moves the cache entries for rename, returning the moved entries
+func (c *fileCache) move(oldname, newname string) []*cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	prefix := subtreePrefix(newname)
+	for n, e := range c.entries {
+		if n == newname || strings.HasPrefix(n, prefix) {
+			c.removeElement(e)
+		}
+	}
+
+	prefix = subtreePrefix(oldname)
+	moved := []*cacheEntry{}
+	for n, e := range c.entries {
+		if n == oldname || strings.HasPrefix(n, prefix) {
+			moved = append(moved, e.Value.(*cacheEntry))
+			c.removeElement(e)
+		}
+	}
+
+	for i, entry := range moved {
+		name := newname + strings.TrimPrefix(entry.name, oldname)
+		moved[i] = &cacheEntry{name: name, fileData: entry.fileData, size: entry.size}
+		c.entries[name] = c.lru.PushFront(moved[i])
+		c.stats.Entries++
+		c.stats.Bytes += entry.size
+	}
+	return moved
+}
+
+// Stats returns the cache counters
+func (c *fileCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.stats
+}
+
+// dirty returns the number of files with unsaved changes
+func (c *fileCache) dirty() int {
+	return len(c.dirtyFiles())
+}
+
+// dirtyFiles returns the file data with unsaved changes
+func (c *fileCache) dirtyFiles() []*FileData {
+	c.Lock()
+	defer c.Unlock()
+
+	var files []*FileData
+	for _, e := range c.entries {
+		fileData := e.Value.(*cacheEntry).fileData
+		if fileData.dirty.Load() {
+			files = append(files, fileData)
+		}
+	}
+	return files
+}
+
+func (c *fileCache) removeElement(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.name)
+	c.stats.Entries--
+	c.stats.Bytes -= entry.size
+}
+
+// resize updates the size of the entry as the file data can change
+func (c *fileCache) resize(entry *cacheEntry) {
+	size := entry.fileData.size.Load()
+	c.stats.Bytes += size - entry.size
+	entry.size = size
+}
+
+// over returns whether the cache is over its budget
+func (c *fileCache) over() bool {
+	return (c.maxEntries > 0 && c.stats.Entries > c.maxEntries) ||
+		(c.maxBytes > 0 && c.stats.Bytes > c.maxBytes)
+}
+
+// trim evicts the least recently used entries that aren't pinned until
+// the cache is within budget
+func (c *fileCache) trim() {
+	for e := c.lru.Back(); e != nil && c.over(); {
+		prev := e.Prev()
+		entry := e.Value.(*cacheEntry)
+
+		if !entry.fileData.dirty.Load() && entry.fileData.handles.Load() == 0 {
+			c.removeElement(e)
+			c.stats.Evictions++
+		}
+		e = prev
+	}
+}
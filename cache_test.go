@@ -0,0 +1,135 @@
+package dfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestCacheEviction(t *testing.T) {
+	fs := NewMemoryFileSystem("", "", WithCacheLimit(3, 0))
+	for i := 0; i < 5; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/%d.txt", i), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := fs.CacheStats(); stats.Entries != 3 || stats.Evictions != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// open files are pinned
+	open, err := fs.Open("/0.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty, err := fs.Create("/dirty.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirty.Write([]byte("dirty"))
+	for i := 1; i < 5; i++ {
+		if _, err := fs.Stat(fmt.Sprintf("/%d.txt", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := fs.cache.get("/0.txt", false); !ok {
+		t.Error("open file was evicted")
+	}
+	if _, ok := fs.cache.get("/dirty.txt", false); !ok {
+		t.Error("dirty file was evicted")
+	}
+	if stats := fs.CacheStats(); stats.Entries != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// and can be evicted once they are closed
+	open.Close()
+	dirty.Close()
+	if stats := fs.CacheStats(); stats.Entries != 3 {
+		t.Errorf("closed stats = %+v", stats)
+	}
+	b, err := afero.ReadFile(fs, "/dirty.txt")
+	if err != nil || string(b) != "dirty" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestCacheBytes(t *testing.T) {
+	fs := NewMemoryFileSystem("", "", WithCacheLimit(0, 1000))
+	data := make([]byte, 400)
+	for i := 0; i < 4; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/%d.bin", i), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := fs.CacheStats(); stats.Bytes > 1000 || stats.Evictions == 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := fs.CacheStats()
+	fs.Stat("/dir/a.txt")
+	fs.Stat("/dir/missing.txt")
+	stats := fs.CacheStats()
+	if stats.Hits != before.Hits+1 || stats.Misses != before.Misses+1 {
+		t.Errorf("before = %+v, after = %+v", before, stats)
+	}
+
+	// removed files are dropped from the cache
+	if err := fs.Remove("/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.cache.get("/dir/a.txt", false); ok {
+		t.Error("removed file is cached")
+	}
+	if err := afero.WriteFile(fs, "/dir/sub/b.txt", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := fs.CacheStats(); stats.Entries != 1 {
+		t.Errorf("entries = %d, want 1 (root)", stats.Entries)
+	}
+}
+
+func TestCacheFileDataLocked(t *testing.T) {
+	fs := NewMemoryFileSystem("", "", WithCacheLimit(1, 0))
+	if err := afero.WriteFile(fs, "/locked.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileData, ok := fs.cache.get("/locked.txt", false)
+	if !ok {
+		t.Fatal("file not cached")
+	}
+
+	// the lock is held while a file is saved, which mustn't hold up the
+	// cache being used for other files
+	fileData.Lock()
+	defer fileData.Unlock()
+
+	done := make(chan error)
+	go func() {
+		fs.cache.get("/locked.txt", false)
+		fs.cache.dirty()
+		done <- afero.WriteFile(fs, "/other.txt", []byte("data"), 0644)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache blocked by the file data lock")
+	}
+	if _, ok := fs.cache.get("/locked.txt", false); ok {
+		t.Error("locked file wasn't evicted")
+	}
+}
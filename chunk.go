@@ -0,0 +1,168 @@
+package dfs
+
+import (
+	"strconv"
+)
+
+type (
+	// chunkData is part of the data of a file that is too large to be
+	// stored in a single datastore entity. The chunks are stored as
+	// children of the file entity.
+	chunkData struct {
+		Data []byte `datastore:"data,noindex"`
+	}
+)
+
+const (
+	// maxChunkSize is the largest amount of data stored in a single
+	// entity, leaving room within the 1Mb datastore entity limit for
+	// the key and other properties
+	maxChunkSize = 1000 * 1000
+
+	// maxChunks limits the size of a file so that all the chunks can be
+	// written in a single transaction (10Mb datastore limit)
+	maxChunks = 10
+
+	// maxBatchKeys is the most keys that can be written or deleted
+	// in a single datastore call
+	maxBatchKeys = 500
+
+	// maxEntityGroups is the most entity groups that can be used in a
+	// single cross-group transaction
+	maxEntityGroups = 25
+
+	// maxTransactionSize is the most data written in a transaction,
+	// leaving room within the 10Mb datastore limit for keys
+	maxTransactionSize = 10 * 1000 * 1000
+
+	// removeBatchSize is the number of files deleted at once, allowing
+	// for each of them to be split into the maximum number of chunks
+	removeBatchSize = maxBatchKeys / (maxChunks + 1)
+)
+
+// implements Entity
+var _ Entity = (*chunkData)(nil)
+
+// Load loads the datastore properties into the chunk
+func (c *chunkData) Load(props []Property) error {
+	for _, p := range props {
+		if p.Name == "data" {
+			c.Data, _ = p.Value.([]byte)
+		}
+	}
+	return nil
+}
+
+// Save returns the datastore properties for the chunk
+func (c *chunkData) Save() ([]Property, error) {
+	return []Property{
+		{Name: "data", Value: c.Data, NoIndex: true},
+	}, nil
+}
+
+// chunkKeys returns the keys of chunks from start up to end for the file
+func (fs *FileSystem) chunkKeys(key *Key, start, end int64) []*Key {
+	keys := []*Key{}
+	for i := start; i < end; i++ {
+		keys = append(keys, &Key{
+			Kind:      fs.kind + "_chunk",
+			Name:      strconv.FormatInt(i, 10),
+			Parent:    key,
+			Namespace: key.Namespace,
+		})
+	}
+	return keys
+}
+
+// splitChunks splits data that is too large to be stored in the file
+// entity into chunks, returning nil if it will fit
+func splitChunks(data []byte) ([]Entity, error) {
+	if len(data) <= maxChunkSize {
+		return nil, nil
+	}
+
+	chunks := []Entity{}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		chunks = append(chunks, &chunkData{Data: data[:n]})
+		data = data[n:]
+	}
+
+	if len(chunks) > maxChunks {
+		return nil, ErrTooLarge
+	}
+	return chunks, nil
+}
+
+// readChunks loads the file entity and the chunks of its encoded data
+func (fs *FileSystem) readChunks(tx Transaction, key *Key, fileData *FileData) error {
+	if err := tx.Get(key, fileData); err != nil {
+		return err
+	}
+	if fileData.Chunks == 0 {
+		return nil
+	}
+
+	data, err := fs.getChunks(tx, key, fileData.Chunks)
+	if err != nil {
+		return err
+	}
+	fileData.encoded = data
+	return nil
+}
+
+// writeChunks saves the file entity and the chunks of its data, deleting
+// any chunks of the previous version of the file that are no longer used
+func (fs *FileSystem) writeChunks(tx Transaction, key *Key, fileData *FileData, chunks []Entity, previous int64) error {
+	fileData.Chunks = int64(len(chunks))
+	if err := tx.Put(key, fileData); err != nil {
+		return err
+	}
+	return fs.putChunks(tx, key, chunks, previous)
+}
+
+// storedSize is the most that is written to store the file entity, read
+// without its chunks, and the chunks of its data
+func storedSize(fileData *FileData) int {
+	props, err := fileData.Save()
+	if err != nil {
+		return maxTransactionSize
+	}
+	return propertiesSize(props) + int(fileData.Chunks)*maxChunkSize
+}
+
+// getChunks loads the data from the chunks stored under the parent key
+func (fs *FileSystem) getChunks(tx Transaction, key *Key, n int64) ([]byte, error) {
+	keys := fs.chunkKeys(key, 0, n)
+	chunks := make([]Entity, len(keys))
+	for i := range chunks {
+		chunks[i] = &chunkData{}
+	}
+	if err := tx.GetMulti(keys, chunks); err != nil {
+		return nil, err
+	}
+
+	data := []byte{}
+	for _, chunk := range chunks {
+		data = append(data, chunk.(*chunkData).Data...)
+	}
+	return data, nil
+}
+
+// putChunks saves the chunks under the parent key, deleting any
+// previous chunks beyond them
+func (fs *FileSystem) putChunks(tx Transaction, key *Key, chunks []Entity, previous int64) error {
+	n := int64(len(chunks))
+	if n > 0 {
+		if err := tx.PutMulti(fs.chunkKeys(key, 0, n), chunks); err != nil {
+			return err
+		}
+	}
+	if previous > n {
+		return tx.DeleteMulti(fs.chunkKeys(key, n, previous))
+	}
+	return nil
+}
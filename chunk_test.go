@@ -0,0 +1,85 @@
+package dfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func countChunks(t *testing.T, d Driver, kind string) int {
+	return len(memoryKeys(t, d, &Query{Kind: kind + "_chunk"}))
+}
+
+func TestChunkedFile(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	data := bytes.Repeat([]byte("0123456789"), maxChunkSize/4)
+	if err := afero.WriteFile(fs, "/large.bin", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, driver, "file"); n != 3 {
+		t.Errorf("chunks = %d, want 3", n)
+	}
+
+	// a new session has to load the data from the chunks
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	fi, err := fs.Stat("/large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(data)) {
+		t.Errorf("size = %d, want %d", fi.Size(), len(data))
+	}
+	b, err := afero.ReadFile(fs, "/large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("chunked data does not match")
+	}
+
+	if err := fs.Rename("/large.bin", "/moved.bin"); err != nil {
+		t.Fatal(err)
+	}
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	b, err = afero.ReadFile(fs, "/moved.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("renamed chunked data does not match")
+	}
+	if n := countChunks(t, driver, "file"); n != 3 {
+		t.Errorf("chunks after rename = %d, want 3", n)
+	}
+
+	// shrinking the file deletes the chunks no longer used
+	if err := afero.WriteFile(fs, "/moved.bin", data[:maxChunkSize+1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, driver, "file"); n != 2 {
+		t.Errorf("chunks after shrinking = %d, want 2", n)
+	}
+
+	if err := fs.Remove("/moved.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countChunks(t, driver, "file"); n != 0 {
+		t.Errorf("chunks after remove = %d, want 0", n)
+	}
+}
+
+func TestChunkedFileTooLarge(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	data := make([]byte, maxChunkSize*maxChunks+1)
+	err := afero.WriteFile(fs, "/huge.bin", data, 0644)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != ErrTooLarge {
+		t.Errorf("err = %v, want %v", err, ErrTooLarge)
+	}
+}
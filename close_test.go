@@ -0,0 +1,282 @@
+package dfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// slowDriver holds up transactions, once started is set, until release is
+// closed
+type slowDriver struct {
+	Driver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *slowDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	if d.started != nil {
+		d.started <- struct{}{}
+		<-d.release
+	}
+	return d.Driver.RunInTransaction(ctx, f)
+}
+
+// storedData returns the saved contents of the file, as another session
+// would see them
+func storedData(t *testing.T, driver Driver, name string) string {
+	b, err := afero.ReadFile(NewDriverFileSystem(context.Background(), driver, "", ""), name)
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCloseFailure(t *testing.T) {
+	driver := newFaultDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	driver.inject("transaction", fault{err: failed})
+	err = f.Close()
+	if pe, ok := err.(*os.PathError); !ok || pe.Op != "close" || pe.Err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if got := storedData(t, driver, "/file"); got != "<missing>" {
+		t.Errorf("stored data = %q", got)
+	}
+	if n := fs.cache.dirty(); n != 1 {
+		t.Errorf("dirty = %d, want 1", n)
+	}
+
+	// the handle is still open so the close can be retried
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Errorf("write err = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedData(t, driver, "/file"); got != "hello world" {
+		t.Errorf("stored data = %q", got)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second close err = %v", err)
+	}
+}
+
+func TestLastCloseSaves(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+	if err := afero.WriteFile(fs, "/file", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changes are shared by the handles so aren't saved until the
+	// last of them is closed
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedData(t, driver, "/file"); got != "v1" {
+		t.Errorf("stored data = %q, want v1", got)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedData(t, driver, "/file"); got != "v2" {
+		t.Errorf("stored data = %q, want v2", got)
+	}
+}
+
+func TestSync(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedData(t, driver, "/file"); got != "hello" {
+		t.Errorf("stored data = %q", got)
+	}
+	if n := fs.cache.dirty(); n != 0 {
+		t.Errorf("dirty = %d, want 0", n)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != ErrFileClosed {
+		t.Errorf("sync after close err = %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	driver := newFaultDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+
+	for _, name := range []string{"/a", "/b"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a file that fails is left dirty to be saved by the next flush
+	failed := errors.New("failed")
+	driver.inject("transaction", fault{err: failed})
+	err := fs.Flush()
+	if pe, ok := err.(*os.PathError); !ok || pe.Op != "flush" || pe.Err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if n := fs.cache.dirty(); n != 1 {
+		t.Errorf("dirty = %d, want 1", n)
+	}
+
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if got := storedData(t, driver, name); got != name {
+			t.Errorf("stored data = %q, want %q", got, name)
+		}
+	}
+}
+
+func TestSaveUnlocked(t *testing.T) {
+	driver := &slowDriver{Driver: NewMemoryDriver()}
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	g, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver.started = make(chan struct{})
+	driver.release = make(chan struct{})
+	done := make(chan error)
+	go func() { done <- f.Sync() }()
+	<-driver.started
+
+	// the file can be read and changed through another handle while it's
+	// saved, and the change is left to be saved
+	changed := make(chan error)
+	go func() {
+		b := make([]byte, 5)
+		if _, err := g.ReadAt(b, 0); err != nil || string(b) != "hello" {
+			changed <- fmt.Errorf("read %q, err = %v", b, err)
+			return
+		}
+		_, err := g.Write([]byte("J"))
+		changed <- err
+	}()
+	select {
+	case err := <-changed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file locked while it's saved")
+	}
+
+	close(driver.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	driver.started, driver.release = nil, nil
+	if got := storedData(t, driver, "/file"); got != "hello" {
+		t.Errorf("stored data = %q", got)
+	}
+	if n := fs.cache.dirty(); n != 1 {
+		t.Errorf("dirty = %d, want 1", n)
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedData(t, driver, "/file"); got != "Jello" {
+		t.Errorf("stored data = %q", got)
+	}
+	if n := fs.cache.dirty(); n != 0 {
+		t.Errorf("dirty = %d, want 0", n)
+	}
+}
+
+func TestCloseRemoved(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+	if err := afero.WriteFile(fs, "/a/saved", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file removed while a handle has unsaved changes isn't saved again
+	// when the handle is closed, whether or not it was saved before
+	for _, name := range []string{"/a/new", "/a/saved"} {
+		f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: stat err = %v", name, err)
+		}
+		if got := storedData(t, driver, name); got != "<missing>" {
+			t.Errorf("%s: stored data = %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// +build !appengine
+
+// Command dfs-migrate moves the files of a datastore filesystem namespace
+// between the flat key layout and the ancestor key layout:
+//
+//     dfs-migrate -project=blog-serve -credentials=service-account.json -namespace=captaincodeman -kind=drafts
+//
+// Use -ancestor=false to move files back to the flat layout.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/datastore"
+	dfs "github.com/captaincodeman/afero-datastore"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+var (
+	project     = flag.String("project", "", "datastore project")
+	credentials = flag.String("credentials", "service-account.json", "service account file for the datastore project")
+	namespace   = flag.String("namespace", "", "namespace of the filesystem")
+	kind        = flag.String("kind", "", "kind of the filesystem entities")
+	ancestor    = flag.Bool("ancestor", true, "move files to the ancestor key layout, or the flat layout if false")
+)
+
+func main() {
+	flag.Parse()
+
+	if *project == "" {
+		fmt.Fprintln(os.Stderr, "dfs-migrate: -project is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := datastore.NewClient(context.Background(), *project, option.WithServiceAccountFile(*credentials))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dfs-migrate:", err)
+		os.Exit(1)
+	}
+
+	opts := []dfs.Option{}
+	if *ancestor {
+		opts = append(opts, dfs.WithAncestorKeys())
+	}
+	fs := dfs.NewFileSystem(client, *namespace, *kind, opts...)
+
+	n, err := fs.MigrateKeys(func(migrated int) {
+		fmt.Println("migrated", migrated, "files")
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dfs-migrate:", err)
+		os.Exit(1)
+	}
+	fmt.Println("done, migrated", n, "files")
+}
@@ -0,0 +1,171 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type (
+	// Codec compresses file data so it is transparent to the caller. The
+	// codec name is recorded in the FileData Format so it can be decoded.
+	Codec interface {
+		Name() string
+		Encode(data []byte) ([]byte, error)
+		Decode(data []byte) ([]byte, error)
+	}
+
+	gzipCodec struct{}
+
+	zstdCodec struct {
+		once    sync.Once
+		encoder *zstd.Encoder
+		decoder *zstd.Decoder
+		err     error
+	}
+
+	snappyCodec struct{}
+)
+
+var (
+	// Gzip compresses data using gzip
+	Gzip Codec = &gzipCodec{}
+
+	// Zstd compresses data using zstandard
+	Zstd Codec = &zstdCodec{}
+
+	// Snappy compresses data using snappy
+	Snappy Codec = &snappyCodec{}
+
+	// DefaultSkipExtensions are file types that are already compressed
+	DefaultSkipExtensions = []string{
+		".jpg", ".jpeg", ".png", ".gif", ".webp",
+		".gz", ".tgz", ".zip", ".bz2", ".xz", ".zst", ".7z",
+		".mp3", ".mp4", ".m4a", ".webm", ".woff", ".woff2", ".pdf",
+	}
+
+	ErrUnknownFormat = errors.New("Unknown format")
+	ErrSizeMismatch  = errors.New("Size mismatch")
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		Gzip.Name():   Gzip,
+		Zstd.Name():   Zstd,
+		Snappy.Name(): Snappy,
+	}
+)
+
+// RegisterCodec makes a codec available to decode file data
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+func lookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// WithCompression compresses file data when it is saved, except for files
+// with any of the skip extensions. If no extensions are provided then the
+// DefaultSkipExtensions are used. Files saved with any registered codec
+// are decompressed when loaded whether or not compression is enabled.
+func WithCompression(codec Codec, skip ...string) Option {
+	return func(fs *FileSystem) {
+		if len(skip) == 0 {
+			skip = DefaultSkipExtensions
+		}
+		fs.codec = codec
+		fs.skip = make(map[string]bool)
+		for _, ext := range skip {
+			fs.skip[strings.ToLower(ext)] = true
+		}
+		RegisterCodec(codec)
+	}
+}
+
+// compress returns whether the file data should be compressed
+func (fs *FileSystem) compress(name string) bool {
+	return fs.codec != nil && !fs.skip[strings.ToLower(filepath.Ext(name))]
+}
+
+func (c *gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (c *zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Encode(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decode(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(data, nil)
+}
+
+func (c *snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (c *snappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (c *snappyCodec) Decode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,76 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("Lorem ipsum dolor sit amet. "), 1000)
+
+	for _, codec := range []Codec{Gzip, Zstd, Snappy} {
+		driver := NewMemoryDriver()
+		fs := NewDriverFileSystem(ctx, driver, "", "", WithCompression(codec))
+
+		if err := afero.WriteFile(fs, "/page.md", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, "/image.PNG", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var fileData FileData
+		if err := driver.Get(ctx, fs.makeKey("/page.md"), &fileData); err != nil {
+			t.Fatal(err)
+		}
+		if fileData.Format != codec.Name() || len(fileData.encoded) >= len(data) {
+			t.Errorf("%s: format = %q, stored %d bytes", codec.Name(), fileData.Format, len(fileData.encoded))
+		}
+		if err := driver.Get(ctx, fs.makeKey("/image.PNG"), &fileData); err != nil {
+			t.Fatal(err)
+		}
+		if fileData.Format != "" {
+			t.Errorf("%s: skipped extension format = %q", codec.Name(), fileData.Format)
+		}
+
+		// loading doesn't depend on compression being enabled
+		fs = NewDriverFileSystem(ctx, driver, "", "")
+		fi, err := fs.Stat("/page.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(data)) {
+			t.Errorf("%s: size = %d, want %d", codec.Name(), fi.Size(), len(data))
+		}
+		b, err := afero.ReadFile(fs, "/page.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: data does not match", codec.Name())
+		}
+	}
+}
+
+func TestCompressionUncompressedEntity(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	if err := afero.WriteFile(fs, "/old.txt", []byte("uncompressed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = NewDriverFileSystem(ctx, driver, "", "", WithCompression(Gzip))
+	b, err := afero.ReadFile(fs, "/old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "uncompressed" {
+		t.Errorf("data = %q, want %q", b, "uncompressed")
+	}
+}
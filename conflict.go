@@ -0,0 +1,87 @@
+package dfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type (
+	// ConflictError is returned when a file can't be saved because it was
+	// changed by another session after it was loaded
+	ConflictError struct {
+		Name       string
+		Generation int64
+		Current    int64
+
+		// Data holds the unsaved changes of a file that was closed, as the
+		// session discards them, so they can be merged with the current
+		// file and saved with WriteFileIf
+		Data []byte
+	}
+)
+
+// anyGeneration saves a file whatever the generation of the stored file
+const anyGeneration = -1
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Conflict saving %s: generation %d, current %d", e.Name, e.Generation, e.Current)
+}
+
+// IsConflict returns whether the error is a *ConflictError, including one
+// wrapped in an *os.PathError
+func IsConflict(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// Generation returns the generation of the file when it was loaded, which
+// can be passed to WriteFileIf to save changes only if it's unchanged. A
+// file saved before generations were recorded is at 0, the same as a file
+// that doesn't exist, until it's next saved.
+func Generation(fi os.FileInfo) int64 {
+	if fileData, ok := fi.Sys().(*FileData); ok {
+		fileData.Lock()
+		defer fileData.Unlock()
+
+		return fileData.Generation
+	}
+	return 0
+}
+
+// WriteFileIf writes data to the named file only if the generation of the
+// stored file matches, or with a generation of 0 only if it doesn't exist,
+// returning the new generation. If the file has been changed by another
+// session a *ConflictError is returned and if the file is a directory an
+// *os.PathError with ErrIsDirectory.
+func (fs *FileSystem) WriteFileIf(name string, data []byte, perm os.FileMode, generation int64) (_ int64, err error) {
+	fs, span := fs.startSpan("WriteFileIf", name)
+	defer span.end(&err)
+
+	name = normalizePath(name)
+
+	if err := fs.makeParent("write", name); err != nil {
+		return 0, err
+	}
+
+	fileData := CreateFile(name)
+	fileData.dirty.Store(false)
+	fileData.Mode = int64(fs.applyUmask(perm))
+	fileData.Data = append(fileData.Data, data...)
+	fileData.Size = int64(len(data))
+	fileData.ModTime = time.Now()
+	fileData.Generation = generation
+
+	if err := fs.saveFileDataIf(fileData, generation); err != nil {
+		if IsConflict(err) {
+			return 0, err
+		}
+		return 0, &os.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	fs.cache.add(name, fileData)
+	return fileData.Generation, nil
+}
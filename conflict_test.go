@@ -0,0 +1,138 @@
+package dfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestConflict(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs1 := NewDriverFileSystem(ctx, driver, "", "")
+	fs2 := NewDriverFileSystem(ctx, driver, "", "")
+
+	if err := afero.WriteFile(fs1, "/page.md", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// both sessions load the same generation
+	f1, err := fs1.OpenFile("/page.md", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := fs2.OpenFile("/page.md", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1.WriteAt([]byte("v2"), 0)
+	f2.WriteAt([]byte("v3"), 0)
+
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = f2.Close()
+	ce, ok := err.(*ConflictError)
+	if !ok || ce.Generation != 1 || ce.Current != 2 {
+		t.Fatalf("err = %v, want conflict", err)
+	}
+
+	// the changes that weren't saved are returned with the conflict
+	if string(ce.Data) != "v3" {
+		t.Errorf("conflict data = %q, want v3", ce.Data)
+	}
+
+	// the session loads the file again after a conflict
+	b, err := afero.ReadFile(fs2, "/page.md")
+	if err != nil || string(b) != "v2" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestWriteFileIf(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	generation, err := fs.WriteFileIf("/page.md", []byte("v1"), 0644, 0)
+	if err != nil || generation != 1 {
+		t.Fatalf("generation = %d, err = %v", generation, err)
+	}
+	if _, err := fs.WriteFileIf("/page.md", []byte("v1"), 0644, 0); !IsConflict(err) {
+		t.Errorf("err = %v, want conflict", err)
+	}
+
+	fi, err := fs.Stat("/page.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generation, err = fs.WriteFileIf("/page.md", []byte("v2"), 0644, Generation(fi))
+	if err != nil || generation != 2 {
+		t.Fatalf("generation = %d, err = %v", generation, err)
+	}
+	if _, err := fs.WriteFileIf("/page.md", []byte("v3"), 0644, 1); !IsConflict(err) {
+		t.Errorf("err = %v, want conflict", err)
+	}
+
+	// metadata changes are new generations too
+	if err := fs.Chmod("/page.md", 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ = fs.Stat("/page.md")
+	if Generation(fi) != 3 {
+		t.Errorf("generation = %d, want 3", Generation(fi))
+	}
+
+	b, err := afero.ReadFile(fs, "/page.md")
+	if err != nil || string(b) != "v2" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestWriteFileIfExisting(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	// a file saved before generations were recorded is at 0
+	if err := afero.WriteFile(fs, "/legacy.md", []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var legacy FileData
+	key := fs.makeKey("/legacy.md")
+	if err := driver.Get(ctx, key, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Generation = 0
+	if err := driver.Put(ctx, key, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	if _, err := fs.WriteFileIf("/legacy.md", []byte("clobber"), 0644, 0); !IsConflict(err) {
+		t.Errorf("legacy err = %v, want conflict", err)
+	}
+	if b, err := afero.ReadFile(fs, "/legacy.md"); err != nil || string(b) != "precious" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+
+	// and a directory is never replaced
+	if err := fs.MkdirAll("/d/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/d/e/child", []byte("child"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	for _, generation := range []int64{0, 1} {
+		_, err := fs.WriteFileIf("/d", []byte("clobber"), 0644, generation)
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != ErrIsDirectory {
+			t.Errorf("generation %d: err = %v, want %v", generation, err, ErrIsDirectory)
+		}
+	}
+	if fi, err := fs.Stat("/d"); err != nil || !fi.IsDir() {
+		t.Errorf("directory err = %v", err)
+	}
+	if _, err := fs.Stat("/d/e/child"); err != nil {
+		t.Errorf("child err = %v", err)
+	}
+}
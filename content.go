@@ -0,0 +1,190 @@
+package dfs
+
+type (
+	// contentData is file data stored once for every file with the same
+	// contents, keyed by the SHA-256 of the encoded data and counting the
+	// number of files that reference it
+	contentData struct {
+		// the encoded data as it is stored
+		encoded []byte
+
+		// Refs is the number of files using the content
+		Refs int64 `datastore:"refs,noindex"`
+
+		// Chunks is the number of chunk entities the data is split into
+		Chunks int64 `datastore:"chunks,noindex"`
+
+		// Blob is the name of the blob used to store the data
+		Blob string `datastore:"blob,noindex"`
+
+		// Checksum is the SHA-256 of the data stored in the Blob
+		Checksum string `datastore:"checksum,noindex"`
+	}
+)
+
+// implements Entity
+var _ Entity = (*contentData)(nil)
+
+// WithDeduplication stores the data of files with identical contents once,
+// in a separate kind keyed by its SHA-256 hash, with the files only keeping
+// the hash. The content is stored in the namespace given so that it can be
+// shared between file systems using different namespaces. Because every
+// file has its own data key, encrypted files are never deduplicated.
+func WithDeduplication(namespace string) Option {
+	return func(fs *FileSystem) {
+		fs.dedup = true
+		fs.contentNamespace = namespace
+	}
+}
+
+// Load loads the datastore properties into the content
+func (c *contentData) Load(props []Property) error {
+	c.encoded = nil
+	c.Chunks = 0
+	c.Blob = ""
+	c.Checksum = ""
+
+	for _, p := range props {
+		switch p.Name {
+		case "refs":
+			c.Refs, _ = p.Value.(int64)
+		case "data":
+			c.encoded, _ = p.Value.([]byte)
+		case "chunks":
+			c.Chunks, _ = p.Value.(int64)
+		case "blob":
+			c.Blob, _ = p.Value.(string)
+		case "checksum":
+			c.Checksum, _ = p.Value.(string)
+		}
+	}
+	return nil
+}
+
+// Save returns the datastore properties for the content
+func (c *contentData) Save() ([]Property, error) {
+	props := []Property{
+		{Name: "refs", Value: c.Refs, NoIndex: true},
+	}
+
+	switch {
+	case c.Blob != "":
+		props = append(props,
+			Property{Name: "blob", Value: c.Blob, NoIndex: true},
+			Property{Name: "checksum", Value: c.Checksum, NoIndex: true})
+	case c.Chunks > 0:
+		props = append(props, Property{Name: "chunks", Value: c.Chunks, NoIndex: true})
+	default:
+		props = append(props, Property{Name: "data", Value: c.encoded, NoIndex: true})
+	}
+	return props, nil
+}
+
+func (fs *FileSystem) contentKey(hash string) *Key {
+	return &Key{
+		Kind:      fs.kind + "_content",
+		Name:      hash,
+		Namespace: fs.contentNamespace,
+	}
+}
+
+// addContent adds a reference to the content for the encoded file data,
+// creating it from the chunks or blob if it doesn't exist. It returns
+// whether the chunks or blob were used.
+func (fs *FileSystem) addContent(tx Transaction, fileData *FileData, chunks []Entity, blob, sum string) (bool, error) {
+	key := fs.contentKey(fileData.Content)
+
+	var content contentData
+	err := tx.Get(key, &content)
+	switch err {
+	case nil:
+		content.Refs++
+		return false, tx.Put(key, &content)
+	case ErrNoSuchEntity:
+	default:
+		return false, err
+	}
+
+	content = contentData{
+		encoded:  fileData.encoded,
+		Refs:     1,
+		Chunks:   int64(len(chunks)),
+		Blob:     blob,
+		Checksum: sum,
+	}
+	if err := tx.Put(key, &content); err != nil {
+		return false, err
+	}
+	return true, fs.putChunks(tx, key, chunks, 0)
+}
+
+// releaseContent removes a reference to the content, deleting it once no
+// files use it. It returns the name of any blob that is then unreferenced.
+func (fs *FileSystem) releaseContent(tx Transaction, hash string) (string, error) {
+	if hash == "" {
+		return "", nil
+	}
+	key := fs.contentKey(hash)
+
+	var content contentData
+	if err := tx.Get(key, &content); err != nil {
+		if err == ErrNoSuchEntity {
+			return "", nil
+		}
+		return "", err
+	}
+
+	content.Refs--
+	if content.Refs > 0 {
+		return "", tx.Put(key, &content)
+	}
+
+	keys := append(fs.chunkKeys(key, 0, content.Chunks), key)
+	return content.Blob, tx.DeleteMulti(keys)
+}
+
+// releaseContents removes a reference to each of the contents in turn,
+// deleting any blobs no longer used
+func (fs *FileSystem) releaseContents(hashes ...string) error {
+	blobs := []string{}
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		var blob string
+		err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+			var err error
+			blob, err = fs.releaseContent(tx, hash)
+			return err
+		})
+		if err != nil {
+			fs.deleteBlobs(blobs...)
+			return err
+		}
+		blobs = append(blobs, blob)
+	}
+	fs.deleteBlobs(blobs...)
+	return nil
+}
+
+// readContent loads the content the file data references, returning the
+// name and checksum of the blob to read if it isn't stored in datastore
+func (fs *FileSystem) readContent(tx Transaction, fileData *FileData) (string, string, error) {
+	key := fs.contentKey(fileData.Content)
+
+	var content contentData
+	if err := tx.Get(key, &content); err != nil {
+		return "", "", err
+	}
+
+	if content.Chunks > 0 {
+		data, err := fs.getChunks(tx, key, content.Chunks)
+		if err != nil {
+			return "", "", err
+		}
+		content.encoded = data
+	}
+
+	fileData.encoded = content.encoded
+	return content.Blob, content.Checksum, nil
+}
@@ -0,0 +1,102 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func contentRefs(t *testing.T, driver Driver, fs *FileSystem) map[string]int64 {
+	q := &Query{Kind: fs.kind + "_content", Namespace: fs.contentNamespace}
+	refs := map[string]int64{}
+	it := driver.Run(context.Background(), q)
+	for {
+		var content contentData
+		k, err := it.Next(&content)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs[k.Name] = content.Refs
+	}
+	return refs
+}
+
+func TestDeduplication(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	theme := bytes.Repeat([]byte("body { color: red; } "), maxChunkSize/10)
+	other := []byte("other")
+
+	// namespaces share the content
+	site1 := NewDriverFileSystem(ctx, driver, "site1", "", WithDeduplication("shared"))
+	site2 := NewDriverFileSystem(ctx, driver, "site2", "", WithDeduplication("shared"))
+	for _, fs := range []*FileSystem{site1, site2} {
+		if err := afero.WriteFile(fs, "/theme/style.css", theme, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := afero.WriteFile(site1, "/copy.css", theme, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(site1, "/other.txt", other, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := contentRefs(t, driver, site1)
+	if len(refs) != 2 || refs[checksum(theme)] != 3 || refs[checksum(other)] != 1 {
+		t.Fatalf("refs = %v", refs)
+	}
+	chunks := &Query{Kind: "file_chunk", Namespace: "shared"}
+	if n := len(memoryKeys(t, driver, chunks)); n != 3 {
+		t.Errorf("chunks = %d, want 3", n)
+	}
+
+	var fileData FileData
+	if err := driver.Get(ctx, site2.makeKey("/theme/style.css"), &fileData); err != nil {
+		t.Fatal(err)
+	}
+	if fileData.Content != checksum(theme) || fileData.Chunks != 0 || len(fileData.encoded) != 0 {
+		t.Errorf("content = %q, chunks = %d, data = %d", fileData.Content, fileData.Chunks, len(fileData.encoded))
+	}
+
+	// references move with renames and are released by changes and removes
+	site1 = NewDriverFileSystem(ctx, driver, "site1", "", WithDeduplication("shared"))
+	if err := site1.Rename("/copy.css", "/other.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := contentRefs(t, driver, site1); len(refs) != 1 || refs[checksum(theme)] != 3 {
+		t.Fatalf("renamed refs = %v", refs)
+	}
+	if err := afero.WriteFile(site1, "/other.txt", other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := site1.RemoveAll("/theme"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := contentRefs(t, driver, site1); len(refs) != 2 || refs[checksum(theme)] != 1 || refs[checksum(other)] != 1 {
+		t.Fatalf("removed refs = %v", refs)
+	}
+
+	site2 = NewDriverFileSystem(ctx, driver, "site2", "", WithDeduplication("shared"))
+	b, err := afero.ReadFile(site2, "/theme/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, theme) {
+		t.Error("data does not match")
+	}
+	if err := site2.Remove("/theme/style.css"); err != nil {
+		t.Fatal(err)
+	}
+	if refs := contentRefs(t, driver, site1); len(refs) != 1 || refs[checksum(other)] != 1 {
+		t.Fatalf("deleted refs = %v", refs)
+	}
+	if n := len(memoryKeys(t, driver, chunks)); n != 0 {
+		t.Errorf("chunks = %d, want 0", n)
+	}
+}
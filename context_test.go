@@ -0,0 +1,121 @@
+package dfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// pathErr returns the error wrapped in an os.PathError
+func pathErr(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return nil
+}
+
+func TestWithContext(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	writeTree(t, fs, "/site", 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	view := fs.WithContext(ctx)
+	if view.Context() != ctx {
+		t.Error("view doesn't use the context")
+	}
+
+	// the view shares the session cache
+	before := fs.CacheStats()
+	if _, err := view.Stat("/site/0.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if hits := view.CacheStats().Hits; hits != before.Hits+1 {
+		t.Errorf("hits = %d, want %d", hits, before.Hits+1)
+	}
+
+	dir, err := view.Open("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	cancel()
+
+	if _, err := dir.Readdir(-1); pathErr(err) != context.Canceled {
+		t.Errorf("readdir err = %v, want canceled", err)
+	}
+	if _, err := view.Stat("/site/missing.txt"); pathErr(err) != context.Canceled {
+		t.Errorf("stat err = %v, want canceled", err)
+	}
+	if err := view.Mkdir("/new", 0755); pathErr(err) != context.Canceled {
+		t.Errorf("mkdir err = %v, want canceled", err)
+	}
+	if err := view.IterDir("/site", func(os.FileInfo) error { return nil }); pathErr(err) != context.Canceled {
+		t.Errorf("iterdir err = %v, want canceled", err)
+	}
+
+	f, err := view.OpenFile("/site/0.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); pathErr(err) != context.Canceled {
+		t.Errorf("close err = %v, want canceled", err)
+	}
+
+	// the original filesystem is unaffected
+	if _, err := fs.Stat("/site/2.txt"); err != nil {
+		t.Error(err)
+	}
+	if _, err := afero.ReadDir(fs, "/site"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithContextDeadline(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	writeTree(t, fs, "/site", 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if _, err := fs.WithContext(ctx).Stat("/site/missing.txt"); pathErr(err) != context.DeadlineExceeded {
+		t.Errorf("stat err = %v, want deadline exceeded", err)
+	}
+}
+
+func TestWithContextRemoveAll(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	n := removeBatchSize * 3
+	writeTree(t, fs, "/site", n)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancelled after the first batch
+	err := fs.WithContext(ctx).RemoveAllFunc("/site", func(removed int) {
+		cancel()
+	})
+	if pathErr(err) != context.Canceled {
+		t.Fatalf("err = %v, want canceled", err)
+	}
+
+	files, err := afero.ReadDir(fs, "/site")
+	if err != nil || len(files) == 0 {
+		t.Errorf("read %d files, err = %v", len(files), err)
+	}
+
+	// and can be completed after
+	if err := fs.RemoveAll("/site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/site"); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+}
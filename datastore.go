@@ -0,0 +1,527 @@
+package dfs
+
+import (
+	"os"
+
+	"path/filepath"
+)
+
+func (fs *FileSystem) makeKey(name string) *Key {
+	key := &Key{
+		Kind:      fs.kind,
+		Name:      name,
+		Namespace: fs.namespace,
+	}
+	if fs.ancestorKeys {
+		if dir := filepath.Dir(name); dir != name {
+			key.Parent = fs.makeKey(dir)
+		}
+	}
+	return key
+}
+
+func (fs *FileSystem) loadFileData(name string) (*FileData, error) {
+	key := fs.makeKey(name)
+	var fileData FileData
+	if err := fs.driver.Get(fs.ctx, key, &fileData); err != nil {
+		if err == ErrNoSuchEntity {
+			return nil, ErrFileNotFound
+		}
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	blob, sum := fileData.Blob, fileData.Checksum
+	if fileData.Chunks > 0 || fileData.Content != "" {
+		// load the file again with the chunks or content so they are consistent
+		err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+			if err := fs.readChunks(tx, key, &fileData); err != nil {
+				return err
+			}
+			blob, sum = fileData.Blob, fileData.Checksum
+			if fileData.Content == "" {
+				return nil
+			}
+			var err error
+			blob, sum, err = fs.readContent(tx, &fileData)
+			return err
+		})
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	if blob != "" {
+		data, err := fs.readBlob(blob, sum)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		fileData.encoded = data
+	}
+
+	if err := fs.decode(&fileData); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	fileData.name = name
+	return &fileData, nil
+}
+
+// saveFileData saves the file data as long as the stored file hasn't been
+// changed since it was loaded. New files are saved unconditionally.
+func (fs *FileSystem) saveFileData(fileData *FileData) error {
+	generation := fileData.Generation
+	if generation == 0 {
+		generation = anyGeneration
+	}
+	return fs.saveFileDataIf(fileData, generation)
+}
+
+// saveDirty saves the file data if it has changed and hasn't been removed.
+// A copy is saved so the lock isn't held while it is written and the file
+// can still be read and changed, which leaves it dirty to be saved again,
+// as does a failure. The ModTime was set by the last change, or Chtimes
+// after it, so is kept.
+func (fs *FileSystem) saveDirty(fileData *FileData) error {
+	fileData.save.Lock()
+	defer fileData.save.Unlock()
+
+	fileData.Lock()
+	if !fileData.dirty.Load() || fileData.removed {
+		fileData.Unlock()
+		return nil
+	}
+	snapshot := fileData.snapshot()
+	changes := fileData.changes
+	fileData.Unlock()
+
+	if err := fs.saveFileData(snapshot); err != nil {
+		if ce, ok := err.(*ConflictError); ok {
+			ce.Data = snapshot.Data
+		}
+		return err
+	}
+
+	fileData.Lock()
+	fileData.saved(snapshot, changes)
+	fileData.Unlock()
+	return nil
+}
+
+// saveFileDataIf saves the file data if the generation of the stored file
+// matches, returning a *ConflictError if it doesn't. A generation of 0 is
+// only matched if there is no stored file, as files saved before their
+// generation was recorded are also at 0. A file never replaces a directory.
+func (fs *FileSystem) saveFileDataIf(fileData *FileData, generation int64) error {
+	return fs.saveFileDataWith(fileData, generation, nil)
+}
+
+// saveFileDataWith saves the file data as saveFileDataIf, if check doesn't
+// return an error when it's called in the same transaction
+func (fs *FileSystem) saveFileDataWith(fileData *FileData, generation int64, check func(tx Transaction) error) error {
+	key := fs.makeKey(fileData.name)
+	if err := fs.encode(fileData); err != nil {
+		return err
+	}
+
+	var chunks []Entity
+	var blob, sum string
+	var err error
+	if fs.useBlob(fileData.encoded) {
+		blob, sum, err = fs.writeBlob(fileData.encoded)
+	} else {
+		chunks, err = splitChunks(fileData.encoded)
+	}
+	if err != nil {
+		return err
+	}
+
+	// shared content holds the chunks or blob instead of the file
+	fileData.Content = ""
+	if fs.dedup && len(fileData.encoded) > 0 {
+		fileData.Content = checksum(fileData.encoded)
+	} else {
+		fileData.Blob = blob
+		fileData.Checksum = sum
+	}
+
+	var unused []string
+	loaded := fileData.Generation
+	err = fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		if check != nil {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+
+		var current FileData
+		err := tx.Get(key, &current)
+		if err != nil && err != ErrNoSuchEntity {
+			return err
+		}
+		exists := err == nil
+		if exists && current.Directory && !fileData.Directory {
+			return ErrIsDirectory
+		}
+		if generation != anyGeneration && (exists && generation == 0 || current.Generation != generation) {
+			return &ConflictError{Name: fileData.name, Generation: generation, Current: current.Generation}
+		}
+		fileData.Generation = current.Generation + 1
+		unused = []string{current.Blob}
+
+		if fileData.Content == "" {
+			released, err := fs.releaseContent(tx, current.Content)
+			if err != nil {
+				return err
+			}
+			unused = append(unused, released)
+			return fs.writeChunks(tx, key, fileData, chunks, current.Chunks)
+		}
+
+		// the file keeps its reference if the content is unchanged
+		used := false
+		if current.Content != fileData.Content {
+			var err error
+			if used, err = fs.addContent(tx, fileData, chunks, blob, sum); err != nil {
+				return err
+			}
+			released, err := fs.releaseContent(tx, current.Content)
+			if err != nil {
+				return err
+			}
+			unused = append(unused, released)
+		}
+		if !used {
+			unused = append(unused, blob)
+		}
+		fileData.Blob = ""
+		fileData.Checksum = ""
+		return fs.writeChunks(tx, key, fileData, nil, current.Chunks)
+	})
+
+	if err != nil {
+		// the new blob was never referenced
+		fs.deleteBlobs(blob)
+		fileData.Generation = loaded
+		return err
+	}
+	fs.deleteBlobs(unused...)
+	return nil
+}
+
+// updateFileData applies the change to the file in the session cache and
+// to the stored entity in a transaction. Changes to a file with unsaved
+// data are stored with the data when it is closed.
+func (fs *FileSystem) updateFileData(op, name string, change func(*FileData)) error {
+	name = normalizePath(name)
+	fileData, err := fs.open(name)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+
+	fileData.Lock()
+	defer fileData.Unlock()
+
+	change(fileData)
+	if fileData.dirty.Load() {
+		fileData.changed()
+		return nil
+	}
+
+	key := fs.makeKey(name)
+	var generation int64
+	err = fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		var current FileData
+		if err := tx.Get(key, &current); err != nil {
+			return err
+		}
+		change(&current)
+		current.Generation++
+		generation = current.Generation
+		return tx.Put(key, &current)
+	})
+	if err != nil {
+		if err == ErrNoSuchEntity {
+			err = ErrFileNotFound
+		}
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// the session is still up to date if nothing else changed the file
+	if fileData.Generation == generation-1 {
+		fileData.Generation = generation
+	}
+	return nil
+}
+
+// saveFileDataMulti saves new directories at generation 1, like a file saved
+// by saveFileDataIf, in transactions within the datastore limit on entity
+// groups. A directory that was saved by another session is kept, and its
+// generation loaded, but any other file returns ErrNotDirectory.
+func (fs *FileSystem) saveFileDataMulti(files []*FileData) error {
+	for len(files) > 0 {
+		batch := files
+		if len(batch) > maxEntityGroups {
+			batch = batch[:maxEntityGroups]
+		}
+		err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+			for _, fileData := range batch {
+				key := fs.makeKey(fileData.name)
+				var current FileData
+				err := tx.Get(key, &current)
+				if err == nil {
+					if !current.Directory {
+						return ErrNotDirectory
+					}
+					fileData.Generation = current.Generation
+					continue
+				}
+				if err != ErrNoSuchEntity {
+					return err
+				}
+				fileData.Generation = 1
+				if err := tx.Put(key, fileData); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		files = files[len(batch):]
+	}
+	return nil
+}
+
+func (fs *FileSystem) deleteFileData(name string) error {
+	key := fs.makeKey(name)
+
+	var blob, released string
+	err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		var fileData FileData
+		if err := tx.Get(key, &fileData); err != nil {
+			if err == ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		blob = fileData.Blob
+
+		var err error
+		if released, err = fs.releaseContent(tx, fileData.Content); err != nil {
+			return err
+		}
+
+		keys := append(fs.chunkKeys(key, 0, fileData.Chunks), key)
+		return tx.DeleteMulti(keys)
+	})
+
+	if err != nil {
+		return err
+	}
+	fs.deleteBlobs(blob, released)
+	return nil
+}
+
+// readDir returns up to limit files in the directory, continuing from the
+// cursor, and the cursor to continue from for the next call
+func (fs *FileSystem) readDir(name, start string, limit int) ([]os.FileInfo, string, error) {
+	files := []os.FileInfo{}
+	cursor, err := fs.iterDir(name, start, limit, func(fi os.FileInfo) error {
+		files = append(files, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return files, cursor, nil
+}
+
+// iterDir calls fn for up to limit files in the directory as they are read,
+// continuing from the cursor, and returns the cursor to continue from
+func (fs *FileSystem) iterDir(name, start string, limit int, fn func(os.FileInfo) error) (string, error) {
+	q := &Query{
+		Kind:      fs.kind,
+		Namespace: fs.namespace,
+		Filters: []Filter{
+			{Property: "parent", Operator: "=", Value: name},
+		},
+		Start: start,
+		Limit: limit,
+	}
+	if fs.ancestorKeys {
+		// the ancestor makes the query strongly consistent
+		q.Ancestor = fs.makeKey(name)
+	}
+
+	it := fs.driver.Run(fs.ctx, q)
+	for {
+		var fileData FileData
+		k, err := it.Next(&fileData)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		fileData.name = k.Name
+
+		if err := fn(NewFileInfo(&fileData)); err != nil {
+			return "", err
+		}
+	}
+
+	return it.Cursor()
+}
+
+// rename moves the file to the new name, replacing any existing file, and
+// returns the generation of the file before and after it was moved
+func (fs *FileSystem) rename(oldname, newname string) (int64, int64, error) {
+	var loaded, generation int64
+	var unused []string
+
+	err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		var err error
+		loaded, generation, unused, err = fs.moveFileData(tx, oldname, newname)
+		return err
+	})
+
+	if err == ErrNoSuchEntity {
+		return 0, 0, ErrFileNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fs.deleteBlobs(unused...)
+	return loaded, generation, nil
+}
+
+// moveFileData moves the file entity and its chunks to the new name in the
+// transaction, replacing any existing file. It returns the generation of
+// the file before and after it was moved and the blobs that are no longer
+// referenced once the transaction is committed.
+func (fs *FileSystem) moveFileData(tx Transaction, oldname, newname string) (int64, int64, []string, error) {
+	return fs.moveFileKey(tx, fs.makeKey(oldname), fs.makeKey(newname), newname)
+}
+
+// moveFileKey moves the file entity and its chunks from the old key to the
+// new key for the name, as moveFileData
+func (fs *FileSystem) moveFileKey(tx Transaction, oldKey, newKey *Key, newname string) (int64, int64, []string, error) {
+	var fileData FileData
+	if err := fs.readChunks(tx, oldKey, &fileData); err != nil {
+		return 0, 0, nil, err
+	}
+	loaded := fileData.Generation
+
+	var existing FileData
+	err := tx.Get(newKey, &existing)
+	if err != nil && err != ErrNoSuchEntity {
+		return 0, 0, nil, err
+	}
+	replaced := err == nil
+
+	// the blob is moved with the file entity but any
+	// blob of a file that was replaced is unreferenced
+	unused := []string{existing.Blob}
+	released, err := fs.releaseContent(tx, existing.Content)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	unused = append(unused, released)
+
+	fileData.name = newname
+	fileData.Parent = filepath.Dir(newname)
+
+	// a session holding the replaced file can't overwrite it
+	if replaced && existing.Generation >= fileData.Generation {
+		fileData.Generation = existing.Generation + 1
+	}
+
+	chunks, err := splitChunks(fileData.encoded)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := fs.writeChunks(tx, newKey, &fileData, chunks, existing.Chunks); err != nil {
+		return 0, 0, nil, err
+	}
+
+	keys := append(fs.chunkKeys(oldKey, 0, fileData.Chunks), oldKey)
+	if err := tx.DeleteMulti(keys); err != nil {
+		return 0, 0, nil, err
+	}
+	return loaded, fileData.Generation, unused, nil
+}
+
+// removeAllDescendents deletes every file below the path in batches and
+// then the path itself, calling progress with the number of files removed
+// so far after each batch. If it is interrupted it can be run again.
+func (fs *FileSystem) removeAllDescendents(path string, progress func(removed int)) error {
+	removed := 0
+	for _, filters := range subtreeFilters(path) {
+		for {
+			q := &Query{
+				Kind:      fs.kind,
+				Namespace: fs.namespace,
+				Filters:   filters,
+				Limit:     removeBatchSize,
+			}
+
+			keys := []*Key{}
+			blobs := []string{}
+			contents := []string{}
+			it := fs.driver.Run(fs.ctx, q)
+			for {
+				var fileData FileData
+				k, err := it.Next(&fileData)
+				if err == ErrIteratorDone {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				keys = append(keys, fs.chunkKeys(k, 0, fileData.Chunks)...)
+				keys = append(keys, k)
+				blobs = append(blobs, fileData.Blob)
+				contents = append(contents, fileData.Content)
+			}
+			if len(keys) == 0 {
+				break
+			}
+
+			if err := fs.removeBatch(keys, blobs, contents); err != nil {
+				return err
+			}
+			removed += len(blobs)
+			if progress != nil {
+				progress(removed)
+			}
+		}
+	}
+
+	// the path itself is removed last so an interrupted removal still exists
+	if err := fs.deleteFileData(path); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(removed + 1)
+	}
+	return nil
+}
+
+// removeBatch deletes the keys of a batch of files and then the blobs and
+// content references they no longer need
+func (fs *FileSystem) removeBatch(keys []*Key, blobs, contents []string) error {
+	if err := fs.driver.DeleteMulti(fs.ctx, keys); err != nil {
+		return err
+	}
+	fs.deleteBlobs(blobs...)
+
+	// the files are deleted first so content is never released while it
+	// is still referenced, at worst it is left with too many references
+	return fs.releaseContents(contents...)
+}
@@ -3,11 +3,6 @@
 package dfs
 
 import (
-	"os"
-	"sync"
-
-	"path/filepath"
-
 	"github.com/qedus/nds"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -17,25 +12,39 @@ import (
 type (
 	// clientImpl struct provides an instance with the same method signatures
 	// as the "cloud.google.com/go/datastore" package so more common datastore
-	// code can be reused. RunInTransaction is missing as it's different
+	// code can be reused. RunInTransaction uses the appengine signature.
 	clientImpl struct {
-		Get         func(c context.Context, key *datastore.Key, val interface{}) error
-		GetMulti    func(c context.Context, keys []*datastore.Key, vals interface{}) error
-		Put         func(c context.Context, key *datastore.Key, val interface{}) (*datastore.Key, error)
-		PutMulti    func(c context.Context, keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error)
-		Delete      func(c context.Context, key *datastore.Key) error
-		DeleteMulti func(c context.Context, keys []*datastore.Key) error
+		Get              func(c context.Context, key *datastore.Key, val interface{}) error
+		GetMulti         func(c context.Context, keys []*datastore.Key, vals interface{}) error
+		Put              func(c context.Context, key *datastore.Key, val interface{}) (*datastore.Key, error)
+		PutMulti         func(c context.Context, keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error)
+		Delete           func(c context.Context, key *datastore.Key) error
+		DeleteMulti      func(c context.Context, keys []*datastore.Key) error
+		RunInTransaction func(c context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error
 	}
 
-	// FileSystem represents an appengine
-	// datastore backed filesystem session
-	FileSystem struct {
-		sync.RWMutex
-		ctx       context.Context
-		client    clientImpl
-		namespace string
-		kind      string
-		data      map[string]*FileData
+	// appengineDriver implements Driver using the
+	// "google.golang.org/appengine/datastore" package
+	appengineDriver struct {
+		client clientImpl
+	}
+
+	// appengineTransaction implements Transaction
+	appengineTransaction struct {
+		ctx    context.Context
+		client clientImpl
+	}
+
+	// appengineIterator implements Iterator
+	appengineIterator struct {
+		ctx context.Context
+		it  *datastore.Iterator
+		err error
+	}
+
+	// appengineEntity adapts an Entity to the datastore PropertyLoadSaver
+	appengineEntity struct {
+		entity Entity
 	}
 
 	clientType byte
@@ -43,21 +52,23 @@ type (
 
 var (
 	standard = clientImpl{
-		Get:         datastore.Get,
-		GetMulti:    datastore.GetMulti,
-		Put:         datastore.Put,
-		PutMulti:    datastore.PutMulti,
-		Delete:      datastore.Delete,
-		DeleteMulti: datastore.DeleteMulti,
+		Get:              datastore.Get,
+		GetMulti:         datastore.GetMulti,
+		Put:              datastore.Put,
+		PutMulti:         datastore.PutMulti,
+		Delete:           datastore.Delete,
+		DeleteMulti:      datastore.DeleteMulti,
+		RunInTransaction: datastore.RunInTransaction,
 	}
 
 	memcache = clientImpl{
-		Get:         nds.Get,
-		GetMulti:    nds.GetMulti,
-		Put:         nds.Put,
-		PutMulti:    nds.PutMulti,
-		Delete:      nds.Delete,
-		DeleteMulti: nds.DeleteMulti,
+		Get:              nds.Get,
+		GetMulti:         nds.GetMulti,
+		Put:              nds.Put,
+		PutMulti:         nds.PutMulti,
+		Delete:           nds.Delete,
+		DeleteMulti:      nds.DeleteMulti,
+		RunInTransaction: nds.RunInTransaction,
 	}
 )
 
@@ -67,14 +78,13 @@ const (
 )
 
 // NewFileSystem creates a new appengine datastore backed filesystem
-func NewFileSystem(ctx context.Context, namespace, kind string, clientType clientType) *FileSystem {
-	logger.Println("create appengine datastore filesystem", namespace)
-
-	if kind == "" {
-		kind = "file"
-	}
-	ctx, _ = appengine.Namespace(ctx, namespace)
+func NewFileSystem(ctx context.Context, namespace, kind string, clientType clientType, opts ...Option) *FileSystem {
+	return NewDriverFileSystem(ctx, NewAppEngineDriver(clientType), namespace, kind, opts...)
+}
 
+// NewAppEngineDriver creates a new Driver using either the
+// raw datastore calls (Standard) or memcache (Memcache)
+func NewAppEngineDriver(clientType clientType) Driver {
 	var client clientImpl
 	switch clientType {
 	case Standard:
@@ -83,134 +93,211 @@ func NewFileSystem(ctx context.Context, namespace, kind string, clientType clien
 		client = memcache
 	}
 
-	return &FileSystem{
-		ctx:       ctx,
-		client:    client,
-		namespace: namespace,
-		kind:      kind,
-		data:      make(map[string]*FileData),
-	}
+	return &appengineDriver{client: client}
 }
 
-func (fs *FileSystem) makeKey(name string) *datastore.Key {
-	return datastore.NewKey(fs.ctx, fs.kind, name, 0, nil)
+func (d *appengineDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	err := d.client.Get(ctx, toAppEngineKey(ctx, key), &appengineEntity{dst})
+	return fromAppEngineError(ctx, err)
 }
 
-func (fs *FileSystem) loadFileData(name string) (*FileData, error) {
-	key := fs.makeKey(name)
-	var fileData FileData
-	if err := fs.client.Get(fs.ctx, key, &fileData); err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			return nil, ErrFileNotFound
-		}
-		return nil, &os.PathError{Op: "open", Path: name, Err: err}
-	}
-
-	fileData.name = name
-	return &fileData, nil
+func (d *appengineDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	_, err := d.client.Put(ctx, toAppEngineKey(ctx, key), &appengineEntity{src})
+	return fromAppEngineError(ctx, err)
 }
 
-func (fs *FileSystem) saveFileData(fileData *FileData) error {
-	key := fs.makeKey(fileData.name)
-	_, err := fs.client.Put(fs.ctx, key, fileData)
-	return err
+func (d *appengineDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	_, err := d.client.PutMulti(ctx, toAppEngineKeys(ctx, keys), toAppEngineEntities(src))
+	return fromAppEngineError(ctx, err)
 }
 
-func (fs *FileSystem) saveFileDataMulti(files []*FileData) error {
-	keys := make([]*datastore.Key, len(files))
-	for i, file := range files {
-		keys[i] = fs.makeKey(file.name)
-	}
-	_, err := fs.client.PutMulti(fs.ctx, keys, files)
-	return err
+func (d *appengineDriver) Delete(ctx context.Context, key *Key) error {
+	err := d.client.Delete(ctx, toAppEngineKey(ctx, key))
+	return fromAppEngineError(ctx, err)
 }
 
-func (fs *FileSystem) deleteFileData(name string) error {
-	key := fs.makeKey(name)
-	return fs.client.Delete(fs.ctx, key)
+func (d *appengineDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	err := d.client.DeleteMulti(ctx, toAppEngineKeys(ctx, keys))
+	return fromAppEngineError(ctx, err)
 }
 
-// TODO: use cursor for continuation rather than offset
-// TODO: provide channel / callback func to populate?
-func (fs *FileSystem) readDir(name string, offset, limit int) ([]os.FileInfo, error) {
-	files := []os.FileInfo{}
+func (d *appengineDriver) Run(ctx context.Context, q *Query) Iterator {
+	ctx, _ = appengine.Namespace(ctx, q.Namespace)
 
-	q := datastore.NewQuery(fs.kind)
-	q = q.Filter("parent =", name)
-	q = q.Order("__key__")
-	q = q.Offset(offset)
-	q = q.KeysOnly()
-	if limit > 0 {
-		q = q.Limit(limit)
+	dq := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(toAppEngineKey(ctx, q.Ancestor))
 	}
-
-	it := q.Run(fs.ctx)
-	for {
-		var fileData FileData
-		k, err := it.Next(&fileData)
-		if err == datastore.Done {
-			break
+	inequality := ""
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Property+" "+f.Operator, f.Value)
+		if f.Operator != "=" {
+			inequality = f.Property
 		}
+	}
+	if inequality != "" {
+		dq = dq.Order(inequality)
+	}
+	dq = dq.Order("__key__")
+	if q.Start != "" {
+		c, err := datastore.DecodeCursor(q.Start)
 		if err != nil {
-			return nil, err
+			return &appengineIterator{err: ErrInvalidCursor}
 		}
-
-		fileData.name = k.StringID()
-
-		files = append(files, NewFileInfo(&fileData))
+		dq = dq.Start(c)
+	}
+	if q.Offset > 0 {
+		dq = dq.Offset(q.Offset)
+	}
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.KeysOnly {
+		dq = dq.KeysOnly()
 	}
 
-	return files, nil
+	return &appengineIterator{ctx: ctx, it: dq.Run(ctx)}
 }
 
-func (fs *FileSystem) rename(oldname, newname string) error {
-	oldKey := fs.makeKey(oldname)
-	newKey := fs.makeKey(newname)
-	newParent := filepath.Dir(newname)
+func (d *appengineDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	err := d.client.RunInTransaction(ctx, func(tc context.Context) error {
+		return f(&appengineTransaction{tc, d.client})
+	}, &datastore.TransactionOptions{XG: true})
+	return fromAppEngineError(ctx, err)
+}
 
-	var fileData FileData
-	var result error
+func (t *appengineTransaction) Get(key *Key, dst Entity) error {
+	err := t.client.Get(t.ctx, toAppEngineKey(t.ctx, key), &appengineEntity{dst})
+	return fromAppEngineError(t.ctx, err)
+}
 
-	err := nds.RunInTransaction(fs.ctx, func(ctx context.Context) error {
-		if err := fs.client.Get(ctx, oldKey, &fileData); err != nil {
-			if err == datastore.ErrNoSuchEntity {
-				result = err
-				return nil
-			}
-			return err
-		}
+func (t *appengineTransaction) GetMulti(keys []*Key, dst []Entity) error {
+	err := t.client.GetMulti(t.ctx, toAppEngineKeys(t.ctx, keys), toAppEngineEntities(dst))
+	return fromAppEngineError(t.ctx, err)
+}
 
-		fileData.name = newname
-		fileData.Parent = newParent
+func (t *appengineTransaction) Put(key *Key, src Entity) error {
+	_, err := t.client.Put(t.ctx, toAppEngineKey(t.ctx, key), &appengineEntity{src})
+	return fromAppEngineError(t.ctx, err)
+}
 
-		if _, err := fs.client.Put(ctx, newKey, &fileData); err != nil {
-			return err
-		}
+func (t *appengineTransaction) PutMulti(keys []*Key, src []Entity) error {
+	_, err := t.client.PutMulti(t.ctx, toAppEngineKeys(t.ctx, keys), toAppEngineEntities(src))
+	return fromAppEngineError(t.ctx, err)
+}
 
-		return fs.client.Delete(ctx, oldKey)
-	}, &datastore.TransactionOptions{XG: true})
+func (t *appengineTransaction) Delete(key *Key) error {
+	err := t.client.Delete(t.ctx, toAppEngineKey(t.ctx, key))
+	return fromAppEngineError(t.ctx, err)
+}
 
-	if result != nil {
-		return result
+func (t *appengineTransaction) DeleteMulti(keys []*Key) error {
+	err := t.client.DeleteMulti(t.ctx, toAppEngineKeys(t.ctx, keys))
+	return fromAppEngineError(t.ctx, err)
+}
+
+func (i *appengineIterator) Next(dst Entity) (*Key, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	var pls datastore.PropertyLoadSaver
+	if dst != nil {
+		pls = &appengineEntity{dst}
 	}
+	k, err := i.it.Next(pls)
+	if err == datastore.Done {
+		return nil, ErrIteratorDone
+	}
+	if err != nil {
+		return nil, fromAppEngineError(i.ctx, err)
+	}
+	return fromAppEngineKey(k), nil
+}
 
-	return err
+func (i *appengineIterator) Cursor() (string, error) {
+	if i.err != nil {
+		return "", i.err
+	}
+	c, err := i.it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
 }
 
-func (fs *FileSystem) removeAllDescendents(path string) error {
-	q := datastore.NewQuery(fs.kind)
-	q = q.Filter("parent >=", path)
-	q = q.Filter("parent <", path+"\x7F")
-	q = q.KeysOnly()
+func (e *appengineEntity) Load(props []datastore.Property) error {
+	ps := make([]Property, len(props))
+	for i, p := range props {
+		ps[i] = Property{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex}
+	}
+	return e.entity.Load(ps)
+}
 
-	keys, err := q.GetAll(fs.ctx, nil)
+func (e *appengineEntity) Save() ([]datastore.Property, error) {
+	ps, err := e.entity.Save()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	props := make([]datastore.Property, len(ps))
+	for i, p := range ps {
+		props[i] = datastore.Property{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex}
+	}
+	return props, nil
+}
+
+func toAppEngineKey(ctx context.Context, key *Key) *datastore.Key {
+	if key == nil {
+		return nil
 	}
+	ctx, _ = appengine.Namespace(ctx, key.Namespace)
+	return datastore.NewKey(ctx, key.Kind, key.Name, 0, toAppEngineKey(ctx, key.Parent))
+}
+
+func toAppEngineKeys(ctx context.Context, keys []*Key) []*datastore.Key {
+	dk := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dk[i] = toAppEngineKey(ctx, key)
+	}
+	return dk
+}
+
+func fromAppEngineKey(k *datastore.Key) *Key {
+	if k == nil {
+		return nil
+	}
+	return &Key{
+		Kind:      k.Kind(),
+		Name:      k.StringID(),
+		Parent:    fromAppEngineKey(k.Parent()),
+		Namespace: k.Namespace(),
+	}
+}
 
-	// add the parent
-	key := fs.makeKey(path)
-	keys = append(keys, key)
+func toAppEngineEntities(src []Entity) []datastore.PropertyLoadSaver {
+	pls := make([]datastore.PropertyLoadSaver, len(src))
+	for i, e := range src {
+		pls[i] = &appengineEntity{e}
+	}
+	return pls
+}
 
-	return fs.client.DeleteMulti(fs.ctx, keys)
+func fromAppEngineError(ctx context.Context, err error) error {
+	err = contextError(ctx, err)
+	if appengine.IsTimeoutError(err) {
+		return &TransientError{Err: err, Uncertain: true}
+	}
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, err := range me {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrNoSuchEntity
+			}
+		}
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return ErrNoSuchEntity
+	case datastore.ErrConcurrentTransaction:
+		return ErrConcurrentTransaction
+	}
+	return err
 }
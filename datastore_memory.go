@@ -0,0 +1,682 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"encoding/base64"
+	"encoding/gob"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// memoryDriver implements Driver entirely in-process, emulating the
+	// datastore behaviour that the filesystem relies on so that it can be
+	// used for hermetic tests
+	memoryDriver struct {
+		sync.RWMutex
+		entities map[string]*memoryEntity
+		versions map[string]int64
+		version  int64
+	}
+
+	// memoryEntity is a stored entity
+	memoryEntity struct {
+		key   *Key
+		props []Property
+	}
+
+	// memoryTransaction implements Transaction by buffering writes and
+	// checking that nothing read or written has changed on commit
+	memoryTransaction struct {
+		ctx      context.Context
+		d        *memoryDriver
+		versions map[string]int64
+		groups   map[string]bool
+		writes   map[string]*memoryEntity
+		order    []string
+	}
+
+	// memoryIterator implements Iterator over a snapshot of results
+	memoryIterator struct {
+		ctx        context.Context
+		results    []*memoryEntity
+		keysOnly   bool
+		inequality string
+		cursor     string
+		last       *memoryEntity
+		err        error
+	}
+
+	// memoryCursor is the position of the last result returned by an
+	// iterator, the inequality property value and key it is sorted by
+	memoryCursor struct {
+		Value interface{}
+		Key   string
+	}
+)
+
+const (
+	// number of times a transaction is attempted when there is contention
+	memoryTransactionAttempts = 3
+
+	// maximum size of an entity, the same as the datastore limit
+	memoryMaxEntitySize = 1048572
+
+	// maximum number of keys written or deleted in a batch
+	memoryMaxBatchKeys = 500
+
+	// maximum number of entity groups used by a transaction
+	memoryMaxEntityGroups = 25
+
+	// maximum size of the entities written by a transaction
+	memoryMaxTransactionSize = 10 << 20
+)
+
+var (
+	errMemoryEntityTooBig      = errors.New("Entity is too big")
+	errMemoryTooManyKeys       = errors.New("Too many keys in a batch")
+	errMemoryTooManyGroups     = errors.New("Too many entity groups in a transaction")
+	errMemoryTransactionTooBig = errors.New("Transaction is too big")
+)
+
+func init() {
+	// the property value types that aren't already registered
+	gob.Register(time.Time{})
+}
+
+// NewMemoryFileSystem creates a new in-memory filesystem
+func NewMemoryFileSystem(namespace, kind string, opts ...Option) *FileSystem {
+	return NewDriverFileSystem(context.Background(), NewMemoryDriver(), namespace, kind, opts...)
+}
+
+// NewMemoryDriver creates a new Driver that stores entities in memory
+func NewMemoryDriver() Driver {
+	return &memoryDriver{
+		entities: make(map[string]*memoryEntity),
+		versions: make(map[string]int64),
+	}
+}
+
+func (d *memoryDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.RLock()
+	e, ok := d.entities[encodeKey(key)]
+	d.RUnlock()
+
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return dst.Load(copyProperties(e.props))
+}
+
+func (d *memoryDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	e, err := newMemoryEntity(key, src)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.put(encodeKey(key), e)
+	return nil
+}
+
+func (d *memoryDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(keys) > memoryMaxBatchKeys {
+		return errMemoryTooManyKeys
+	}
+
+	entities := make([]*memoryEntity, len(keys))
+	for i, key := range keys {
+		e, err := newMemoryEntity(key, src[i])
+		if err != nil {
+			return err
+		}
+		entities[i] = e
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for i, key := range keys {
+		d.put(encodeKey(key), entities[i])
+	}
+	return nil
+}
+
+func (d *memoryDriver) Delete(ctx context.Context, key *Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.put(encodeKey(key), nil)
+	return nil
+}
+
+func (d *memoryDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(keys) > memoryMaxBatchKeys {
+		return errMemoryTooManyKeys
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, key := range keys {
+		d.put(encodeKey(key), nil)
+	}
+	return nil
+}
+
+func (d *memoryDriver) Run(ctx context.Context, q *Query) Iterator {
+	if err := ctx.Err(); err != nil {
+		return &memoryIterator{err: err}
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	ancestor := ""
+	if q.Ancestor != nil {
+		ancestor = encodeKey(q.Ancestor)
+	}
+
+	inequality := ""
+	results := []*memoryEntity{}
+	for k, e := range d.entities {
+		if e.key.Kind != q.Kind || e.key.Namespace != q.Namespace {
+			continue
+		}
+		// the encoded key of a descendant starts with that of the ancestor
+		if !strings.HasPrefix(k, ancestor) {
+			continue
+		}
+		if !e.matches(q.Filters) {
+			continue
+		}
+		results = append(results, e)
+	}
+
+	for _, f := range q.Filters {
+		if f.Operator != "=" {
+			inequality = f.Property
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if inequality != "" {
+			a, _ := results[i].indexed(inequality)
+			b, _ := results[j].indexed(inequality)
+			if c, _ := compareValues(a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return encodeKey(results[i].key) < encodeKey(results[j].key)
+	})
+
+	if q.Start != "" {
+		start, err := decodeMemoryCursor(q.Start)
+		if err != nil {
+			return &memoryIterator{err: ErrInvalidCursor}
+		}
+		// skip the results up to and including the cursor position
+		n := sort.Search(len(results), func(i int) bool {
+			return start.before(results[i], inequality)
+		})
+		results = results[n:]
+	}
+
+	if q.Offset > 0 {
+		if q.Offset > len(results) {
+			results = results[:0]
+		} else {
+			results = results[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && q.Limit < len(results) {
+		results = results[:q.Limit]
+	}
+
+	return &memoryIterator{
+		ctx:        ctx,
+		results:    results,
+		keysOnly:   q.KeysOnly,
+		inequality: inequality,
+		cursor:     q.Start,
+	}
+}
+
+func (d *memoryDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	for attempt := 0; attempt < memoryTransactionAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tx := &memoryTransaction{
+			ctx:      ctx,
+			d:        d,
+			versions: make(map[string]int64),
+			groups:   make(map[string]bool),
+			writes:   make(map[string]*memoryEntity),
+		}
+		if err := f(tx); err != nil {
+			return err
+		}
+		if err := tx.check(); err != nil {
+			return err
+		}
+		// a transaction is abandoned rather than committed once the
+		// context is done
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if tx.commit() {
+			return nil
+		}
+	}
+	return ErrConcurrentTransaction
+}
+
+// put stores or, if e is nil, deletes the entity for the encoded key and
+// must be called with the write lock held
+func (d *memoryDriver) put(k string, e *memoryEntity) {
+	if e == nil {
+		delete(d.entities, k)
+	} else {
+		d.entities[k] = e
+	}
+	d.version++
+	d.versions[k] = d.version
+}
+
+func (t *memoryTransaction) Get(key *Key, dst Entity) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	k := encodeKey(key)
+
+	t.d.RLock()
+	e, ok := t.d.entities[k]
+	t.track(k)
+	t.d.RUnlock()
+	t.groups[entityGroup(key)] = true
+
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return dst.Load(copyProperties(e.props))
+}
+
+func (t *memoryTransaction) GetMulti(keys []*Key, dst []Entity) error {
+	for i, key := range keys {
+		if err := t.Get(key, dst[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransaction) Put(key *Key, src Entity) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	e, err := newMemoryEntity(key, src)
+	if err != nil {
+		return err
+	}
+	t.write(key, e)
+	return nil
+}
+
+func (t *memoryTransaction) PutMulti(keys []*Key, src []Entity) error {
+	if len(keys) > memoryMaxBatchKeys {
+		return errMemoryTooManyKeys
+	}
+	for i, key := range keys {
+		if err := t.Put(key, src[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransaction) Delete(key *Key) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	t.write(key, nil)
+	return nil
+}
+
+func (t *memoryTransaction) DeleteMulti(keys []*Key) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	if len(keys) > memoryMaxBatchKeys {
+		return errMemoryTooManyKeys
+	}
+	for _, key := range keys {
+		t.write(key, nil)
+	}
+	return nil
+}
+
+// track records the version of an entity the first time the transaction
+// accesses it and must be called with the driver lock held
+func (t *memoryTransaction) track(k string) {
+	if _, ok := t.versions[k]; !ok {
+		t.versions[k] = t.d.versions[k]
+	}
+}
+
+func (t *memoryTransaction) write(key *Key, e *memoryEntity) {
+	k := encodeKey(key)
+	t.d.RLock()
+	t.track(k)
+	t.d.RUnlock()
+	t.groups[entityGroup(key)] = true
+
+	if _, ok := t.writes[k]; !ok {
+		t.order = append(t.order, k)
+	}
+	t.writes[k] = e
+}
+
+// check returns an error if the transaction is over the datastore limits
+// on the entity groups it uses or the size of the entities it writes
+func (t *memoryTransaction) check() error {
+	if len(t.groups) > memoryMaxEntityGroups {
+		return errMemoryTooManyGroups
+	}
+	size := 0
+	for k, e := range t.writes {
+		if e == nil {
+			size += len(k)
+		} else {
+			size += entitySize(e.key, e.props)
+		}
+	}
+	if size > memoryMaxTransactionSize {
+		return errMemoryTransactionTooBig
+	}
+	return nil
+}
+
+// commit applies the buffered writes if no entity accessed by the
+// transaction has been changed since, returning false if it has
+func (t *memoryTransaction) commit() bool {
+	t.d.Lock()
+	defer t.d.Unlock()
+
+	for k, version := range t.versions {
+		if t.d.versions[k] != version {
+			return false
+		}
+	}
+	for _, k := range t.order {
+		t.d.put(k, t.writes[k])
+	}
+	return true
+}
+
+func (i *memoryIterator) Next(dst Entity) (*Key, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if err := i.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(i.results) == 0 {
+		return nil, ErrIteratorDone
+	}
+	e := i.results[0]
+	i.results = i.results[1:]
+	i.last = e
+
+	if !i.keysOnly && dst != nil {
+		if err := dst.Load(copyProperties(e.props)); err != nil {
+			return nil, err
+		}
+	}
+	return copyKey(e.key), nil
+}
+
+func (i *memoryIterator) Cursor() (string, error) {
+	if i.err != nil {
+		return "", i.err
+	}
+	if i.last == nil {
+		return i.cursor, nil
+	}
+
+	c := memoryCursor{Key: encodeKey(i.last.key)}
+	if i.inequality != "" {
+		c.Value, _ = i.last.indexed(i.inequality)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&c); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeMemoryCursor(s string) (*memoryCursor, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c memoryCursor
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// before returns whether the cursor position is before the entity
+func (c *memoryCursor) before(e *memoryEntity, inequality string) bool {
+	if inequality != "" {
+		v, _ := e.indexed(inequality)
+		if n, _ := compareValues(c.Value, v); n != 0 {
+			return n < 0
+		}
+	}
+	return c.Key < encodeKey(e.key)
+}
+
+func newMemoryEntity(key *Key, src Entity) (*memoryEntity, error) {
+	props, err := src.Save()
+	if err != nil {
+		return nil, err
+	}
+	if entitySize(key, props) > memoryMaxEntitySize {
+		return nil, errMemoryEntityTooBig
+	}
+	return &memoryEntity{key: copyKey(key), props: copyProperties(props)}, nil
+}
+
+// entityGroup returns the encoded root key of the entity group of the key
+func entityGroup(key *Key) string {
+	for key.Parent != nil {
+		key = key.Parent
+	}
+	return encodeKey(key)
+}
+
+// entitySize approximates the stored size of an entity
+func entitySize(key *Key, props []Property) int {
+	return len(encodeKey(key)) + propertiesSize(props)
+}
+
+// propertiesSize approximates the stored size of the properties
+func propertiesSize(props []Property) int {
+	size := 0
+	for _, p := range props {
+		size += len(p.Name)
+		switch v := p.Value.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// indexed returns the value of an indexed property
+func (e *memoryEntity) indexed(name string) (interface{}, bool) {
+	for _, p := range e.props {
+		if p.Name == name && !p.NoIndex {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// matches returns whether the entity satisfies all the filters, as with
+// the datastore only indexed properties can be matched
+func (e *memoryEntity) matches(filters []Filter) bool {
+	for _, f := range filters {
+		v, ok := e.indexed(f.Property)
+		if !ok {
+			return false
+		}
+		c, ok := compareValues(v, f.Value)
+		if !ok {
+			return false
+		}
+		switch f.Operator {
+		case "=":
+			ok = c == 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		default:
+			ok = false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeKey converts a key into a string that sorts in the same order as
+// the datastore orders keys: by each path element from the root, kind
+// first and then name
+func encodeKey(key *Key) string {
+	path := []*Key{}
+	for k := key; k != nil; k = k.Parent {
+		path = append(path, k)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(key.Namespace)
+	buf.WriteByte(0)
+	for i := len(path) - 1; i >= 0; i-- {
+		buf.WriteString(path[i].Kind)
+		buf.WriteByte(0)
+		buf.WriteString(path[i].Name)
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
+func copyKey(key *Key) *Key {
+	if key == nil {
+		return nil
+	}
+	k := *key
+	k.Parent = copyKey(key.Parent)
+	return &k
+}
+
+func copyProperties(props []Property) []Property {
+	c := make([]Property, len(props))
+	for i, p := range props {
+		c[i] = p
+		if b, ok := p.Value.([]byte); ok {
+			c[i].Value = append([]byte(nil), b...)
+		}
+	}
+	return c
+}
+
+// compareValues compares two property values of the same type, returning
+// false if they are of different or unsupported types
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case int64:
+		if bv, ok := b.(int64); ok {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
+			}
+			return 0, true
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1, true
+			case av.After(bv):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
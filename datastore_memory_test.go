@@ -0,0 +1,247 @@
+package dfs
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func memoryKeys(t *testing.T, d Driver, q *Query) []string {
+	names := []string{}
+	it := d.Run(context.Background(), q)
+	for {
+		k, err := it.Next(nil)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, k.Name)
+	}
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryDriverQuery(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDriver()
+
+	for _, name := range []string{"/b/2", "/a/1", "/b/1", "/a", "/b", "/c/1"} {
+		key := &Key{Kind: "file", Name: name, Namespace: "ns"}
+		if err := d.Put(ctx, key, CreateFile(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// same name in another namespace and kind should never be returned
+	d.Put(ctx, &Key{Kind: "file", Name: "/b/3"}, CreateFile("/b/3"))
+	d.Put(ctx, &Key{Kind: "other", Name: "/b/4", Namespace: "ns"}, CreateFile("/b/4"))
+
+	tests := []struct {
+		query *Query
+		want  []string
+	}{
+		{
+			&Query{Kind: "file", Namespace: "ns"},
+			[]string{"/a", "/a/1", "/b", "/b/1", "/b/2", "/c/1"},
+		},
+		{
+			&Query{Kind: "file", Namespace: "ns", Filters: []Filter{{"parent", "=", "/b"}}},
+			[]string{"/b/1", "/b/2"},
+		},
+		{
+			&Query{Kind: "file", Namespace: "ns", Filters: []Filter{{"parent", "=", "/b"}}, Offset: 1},
+			[]string{"/b/2"},
+		},
+		{
+			&Query{Kind: "file", Namespace: "ns", Filters: []Filter{{"parent", ">", "/"}}, Limit: 3},
+			[]string{"/a/1", "/b/1", "/b/2"},
+		},
+		{
+			// data is not indexed so can never be matched
+			&Query{Kind: "file", Namespace: "ns", Filters: []Filter{{"data", "=", []byte{}}}},
+			[]string{},
+		},
+	}
+
+	for i, tt := range tests {
+		if got := memoryKeys(t, d, tt.query); !equalNames(got, tt.want) {
+			t.Errorf("#%d: got %v want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDriverCursor(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDriver()
+
+	for _, name := range []string{"/a", "/a/1", "/b", "/b/1", "/c/1", "/c/2"} {
+		key := &Key{Kind: "file", Name: name}
+		if err := d.Put(ctx, key, CreateFile(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, filters := range [][]Filter{nil, {{"parent", ">", "/"}}} {
+		got := []string{}
+		added := []*Key{}
+		start := ""
+		for page := 0; ; page++ {
+			q := &Query{Kind: "file", Filters: filters, Start: start, Limit: 2, KeysOnly: true}
+			names := memoryKeys(t, d, q)
+			if len(names) == 0 {
+				break
+			}
+			got = append(got, names...)
+
+			it := d.Run(ctx, q)
+			for range names {
+				it.Next(nil)
+			}
+			cursor, err := it.Cursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			start = cursor
+
+			// entities added before the cursor don't change the next page
+			name := fmt.Sprintf("/%d/%d", page, page)
+			d.Put(ctx, &Key{Kind: "file", Name: name}, CreateFile(name))
+			added = append(added, &Key{Kind: "file", Name: name})
+		}
+		want := []string{"/a", "/a/1", "/b", "/b/1", "/c/1", "/c/2"}
+		if filters != nil {
+			want = []string{"/a/1", "/b/1", "/c/1", "/c/2"}
+		}
+		if !equalNames(got, want) {
+			t.Errorf("%v: got %v want %v", filters, got, want)
+		}
+		d.DeleteMulti(ctx, added)
+	}
+
+	if _, err := d.Run(ctx, &Query{Kind: "file", Start: "invalid"}).Next(nil); err != ErrInvalidCursor {
+		t.Errorf("err = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestMemoryDriverTransaction(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDriver()
+	key := &Key{Kind: "file", Name: "/a"}
+	d.Put(ctx, key, CreateFile("/a"))
+
+	attempts := 0
+	err := d.RunInTransaction(ctx, func(tx Transaction) error {
+		attempts++
+		var fileData FileData
+		if err := tx.Get(key, &fileData); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// a write outside of the transaction causes it to be retried
+			d.Put(ctx, key, CreateFile("/a"))
+		}
+		fileData.Size = 42
+		return tx.Put(key, &fileData)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("transaction attempts = %d, want 2", attempts)
+	}
+
+	var fileData FileData
+	if err := d.Get(ctx, key, &fileData); err != nil {
+		t.Fatal(err)
+	}
+	if fileData.Size != 42 {
+		t.Errorf("size = %d, want 42", fileData.Size)
+	}
+
+	err = d.RunInTransaction(ctx, func(tx Transaction) error {
+		tx.Get(key, &fileData)
+		d.Delete(ctx, key)
+		return tx.Delete(key)
+	})
+	if err != ErrConcurrentTransaction {
+		t.Errorf("err = %v, want %v", err, ErrConcurrentTransaction)
+	}
+}
+
+func TestMemoryDriverLimits(t *testing.T) {
+	ctx := context.Background()
+	d := NewMemoryDriver()
+
+	keys := make([]*Key, memoryMaxBatchKeys+1)
+	src := make([]Entity, len(keys))
+	for i := range keys {
+		keys[i] = &Key{Kind: "file", Name: fmt.Sprintf("/%d", i)}
+		src[i] = CreateFile(keys[i].Name)
+	}
+	if err := d.PutMulti(ctx, keys, src); err != errMemoryTooManyKeys {
+		t.Errorf("put batch err = %v, want %v", err, errMemoryTooManyKeys)
+	}
+	if err := d.DeleteMulti(ctx, keys); err != errMemoryTooManyKeys {
+		t.Errorf("delete batch err = %v, want %v", err, errMemoryTooManyKeys)
+	}
+	err := d.RunInTransaction(ctx, func(tx Transaction) error {
+		return tx.PutMulti(keys, src)
+	})
+	if err != errMemoryTooManyKeys {
+		t.Errorf("transaction batch err = %v, want %v", err, errMemoryTooManyKeys)
+	}
+
+	// every root entity is its own entity group
+	err = d.RunInTransaction(ctx, func(tx Transaction) error {
+		for _, key := range keys[:memoryMaxEntityGroups+1] {
+			var fileData FileData
+			if err := tx.Get(key, &fileData); err != nil && err != ErrNoSuchEntity {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != errMemoryTooManyGroups {
+		t.Errorf("groups err = %v, want %v", err, errMemoryTooManyGroups)
+	}
+
+	// but children are in the group of their parent
+	err = d.RunInTransaction(ctx, func(tx Transaction) error {
+		for _, key := range keys[:memoryMaxEntityGroups+1] {
+			key := &Key{Kind: "file", Name: key.Name, Parent: keys[0]}
+			if err := tx.Put(key, CreateFile(key.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("children err = %v", err)
+	}
+
+	err = d.RunInTransaction(ctx, func(tx Transaction) error {
+		data := make([]byte, maxChunkSize)
+		for _, key := range keys[:11] {
+			if err := tx.Put(key, &chunkData{Data: data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != errMemoryTransactionTooBig {
+		t.Errorf("size err = %v, want %v", err, errMemoryTransactionTooBig)
+	}
+}
@@ -3,168 +3,254 @@
 package dfs
 
 import (
-	"os"
-	"sync"
-
-	"path/filepath"
-
 	"cloud.google.com/go/datastore"
 	"golang.org/x/net/context"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type (
-	// FileSystem represents an appengine
-	// datastore backed filesystem session
-	FileSystem struct {
-		sync.RWMutex
-		ctx       context.Context
-		client    *datastore.Client
-		namespace string
-		kind      string
-		data      map[string]*FileData
+	// cloudDriver implements Driver using the
+	// "cloud.google.com/go/datastore" package
+	cloudDriver struct {
+		client *datastore.Client
 	}
-)
 
-// NewFileSystem creates a new appengine datastore backed filesystem
-func NewFileSystem(client *datastore.Client, namespace, kind string) *FileSystem {
-	logger.Println("create standalone datastore filesystem", namespace)
-	
-	if kind == "" {
-		kind = "file"
+	// cloudTransaction implements Transaction
+	cloudTransaction struct {
+		ctx context.Context
+		tx  *datastore.Transaction
 	}
 
-	return &FileSystem{
-		ctx:       context.Background(),
-		client:    client,
-		namespace: namespace,
-		kind:      kind,
-		data:      make(map[string]*FileData),
+	// cloudIterator implements Iterator
+	cloudIterator struct {
+		ctx context.Context
+		it  *datastore.Iterator
+		err error
 	}
-}
 
-func (fs *FileSystem) makeKey(name string) *datastore.Key {
-	key := datastore.NameKey(fs.kind, name, nil)
-	key.Namespace = fs.namespace
-	return key
+	// cloudEntity adapts an Entity to the datastore PropertyLoadSaver
+	cloudEntity struct {
+		entity Entity
+	}
+)
+
+// NewFileSystem creates a new appengine datastore backed filesystem
+func NewFileSystem(client *datastore.Client, namespace, kind string, opts ...Option) *FileSystem {
+	return NewDriverFileSystem(context.Background(), NewCloudDriver(client), namespace, kind, opts...)
 }
 
-func (fs *FileSystem) loadFileData(name string) (*FileData, error) {
-	key := fs.makeKey(name)
-	var fileData FileData
-	if err := fs.client.Get(fs.ctx, key, &fileData); err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			return nil, ErrFileNotFound
-		}
-		return nil, &os.PathError{Op: "open", Path: name, Err: err}
-	}
+// NewCloudDriver creates a new Driver using the datastore client
+func NewCloudDriver(client *datastore.Client) Driver {
+	return &cloudDriver{client: client}
+}
 
-	fileData.name = name
-	return &fileData, nil
+func (d *cloudDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	err := d.client.Get(ctx, toCloudKey(key), &cloudEntity{dst})
+	return fromCloudError(ctx, err)
 }
 
-func (fs *FileSystem) saveFileData(fileData *FileData) error {
-	key := fs.makeKey(fileData.name)
-	_, err := fs.client.Put(fs.ctx, key, fileData)
-	return err
+func (d *cloudDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	_, err := d.client.Put(ctx, toCloudKey(key), &cloudEntity{src})
+	return fromCloudError(ctx, err)
 }
 
-func (fs *FileSystem) saveFileDataMulti(files []*FileData) error {
-	keys := make([]*datastore.Key, len(files))
-	for i, file := range files {
-		keys[i] = fs.makeKey(file.name)
-	}
-	_, err := fs.client.PutMulti(fs.ctx, keys, files)
-	return err
+func (d *cloudDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	_, err := d.client.PutMulti(ctx, toCloudKeys(keys), toCloudEntities(src))
+	return fromCloudError(ctx, err)
 }
 
-func (fs *FileSystem) deleteFileData(name string) error {
-	key := fs.makeKey(name)
-	return fs.client.Delete(fs.ctx, key)
+func (d *cloudDriver) Delete(ctx context.Context, key *Key) error {
+	err := d.client.Delete(ctx, toCloudKey(key))
+	return fromCloudError(ctx, err)
 }
 
-// TODO: use cursor for continuation rather than offset
-// TODO: provide channel / callback func to populate?
-func (fs *FileSystem) readDir(name string, offset, limit int) ([]os.FileInfo, error) {
-	files := []os.FileInfo{}
+func (d *cloudDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	err := d.client.DeleteMulti(ctx, toCloudKeys(keys))
+	return fromCloudError(ctx, err)
+}
 
-	q := datastore.NewQuery(fs.kind)
-	q = q.Filter("parent =", name)
-	q = q.Order("__key__")
-	q = q.Namespace(fs.namespace)
-	q = q.Offset(offset)
-	if limit > 0 {
-		q = q.Limit(limit)
+func (d *cloudDriver) Run(ctx context.Context, q *Query) Iterator {
+	dq := datastore.NewQuery(q.Kind)
+	dq = dq.Namespace(q.Namespace)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(toCloudKey(q.Ancestor))
 	}
-
-	it := fs.client.Run(fs.ctx, q)
-	for {
-		var fileData FileData
-		k, err := it.Next(&fileData)
-		if err == iterator.Done {
-			break
+	inequality := ""
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Property+" "+f.Operator, f.Value)
+		if f.Operator != "=" {
+			inequality = f.Property
 		}
+	}
+	if inequality != "" {
+		dq = dq.Order(inequality)
+	}
+	dq = dq.Order("__key__")
+	if q.Start != "" {
+		c, err := datastore.DecodeCursor(q.Start)
 		if err != nil {
-			return nil, err
+			return &cloudIterator{err: ErrInvalidCursor}
 		}
-
-		fileData.name = k.Name
-
-		files = append(files, NewFileInfo(&fileData))
+		dq = dq.Start(c)
+	}
+	if q.Offset > 0 {
+		dq = dq.Offset(q.Offset)
+	}
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.KeysOnly {
+		dq = dq.KeysOnly()
 	}
 
-	return files, nil
+	return &cloudIterator{ctx: ctx, it: d.client.Run(ctx, dq)}
 }
 
-func (fs *FileSystem) rename(oldname, newname string) error {
-	oldKey := fs.makeKey(oldname)
-	newKey := fs.makeKey(newname)
-	newParent := filepath.Dir(newname)
+func (d *cloudDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&cloudTransaction{ctx, tx})
+	})
+	return fromCloudError(ctx, err)
+}
 
-	var fileData FileData
-	var result error
+func (t *cloudTransaction) Get(key *Key, dst Entity) error {
+	err := t.tx.Get(toCloudKey(key), &cloudEntity{dst})
+	return fromCloudError(t.ctx, err)
+}
 
-	_, err := fs.client.RunInTransaction(fs.ctx, func(tx *datastore.Transaction) error {
-		if err := tx.Get(oldKey, &fileData); err != nil {
-			if err == datastore.ErrNoSuchEntity {
-				result = err
-				return nil
-			}
-			return err
-		}
+func (t *cloudTransaction) GetMulti(keys []*Key, dst []Entity) error {
+	err := t.tx.GetMulti(toCloudKeys(keys), toCloudEntities(dst))
+	return fromCloudError(t.ctx, err)
+}
 
-		fileData.name = newname
-		fileData.Parent = newParent
+func (t *cloudTransaction) Put(key *Key, src Entity) error {
+	_, err := t.tx.Put(toCloudKey(key), &cloudEntity{src})
+	return fromCloudError(t.ctx, err)
+}
 
-		if _, err := tx.Put(newKey, &fileData); err != nil {
-			return err
-		}
+func (t *cloudTransaction) PutMulti(keys []*Key, src []Entity) error {
+	_, err := t.tx.PutMulti(toCloudKeys(keys), toCloudEntities(src))
+	return fromCloudError(t.ctx, err)
+}
 
-		return tx.Delete(oldKey)
-	})
+func (t *cloudTransaction) Delete(key *Key) error {
+	err := t.tx.Delete(toCloudKey(key))
+	return fromCloudError(t.ctx, err)
+}
+
+func (t *cloudTransaction) DeleteMulti(keys []*Key) error {
+	err := t.tx.DeleteMulti(toCloudKeys(keys))
+	return fromCloudError(t.ctx, err)
+}
 
-	if result != nil {
-		return result
+func (i *cloudIterator) Next(dst Entity) (*Key, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	var pls datastore.PropertyLoadSaver
+	if dst != nil {
+		pls = &cloudEntity{dst}
+	}
+	k, err := i.it.Next(pls)
+	if err == iterator.Done {
+		return nil, ErrIteratorDone
 	}
+	if err != nil {
+		return nil, fromCloudError(i.ctx, err)
+	}
+	return fromCloudKey(k), nil
+}
 
-	return err
+func (i *cloudIterator) Cursor() (string, error) {
+	if i.err != nil {
+		return "", i.err
+	}
+	c, err := i.it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
 }
 
-func (fs *FileSystem) removeAllDescendents(path string) error {
-	q := datastore.NewQuery(fs.kind)
-	q = q.Filter("parent >=", path)
-	q = q.Filter("parent <", path+"\x7F")
-	q = q.Namespace(fs.namespace)
-	q = q.KeysOnly()
+func (e *cloudEntity) Load(props []datastore.Property) error {
+	ps := make([]Property, len(props))
+	for i, p := range props {
+		ps[i] = Property{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex}
+	}
+	return e.entity.Load(ps)
+}
 
-	keys, err := fs.client.GetAll(fs.ctx, q, nil)
+func (e *cloudEntity) Save() ([]datastore.Property, error) {
+	ps, err := e.entity.Save()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	props := make([]datastore.Property, len(ps))
+	for i, p := range ps {
+		props[i] = datastore.Property{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex}
+	}
+	return props, nil
+}
 
-	// add the parent
-	key := fs.makeKey(path)
-	keys = append(keys, key)
+func toCloudKey(key *Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	k := datastore.NameKey(key.Kind, key.Name, toCloudKey(key.Parent))
+	k.Namespace = key.Namespace
+	return k
+}
 
-	return fs.client.DeleteMulti(fs.ctx, keys)
+func toCloudKeys(keys []*Key) []*datastore.Key {
+	dk := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dk[i] = toCloudKey(key)
+	}
+	return dk
+}
+
+func fromCloudKey(k *datastore.Key) *Key {
+	if k == nil {
+		return nil
+	}
+	return &Key{
+		Kind:      k.Kind,
+		Name:      k.Name,
+		Parent:    fromCloudKey(k.Parent),
+		Namespace: k.Namespace,
+	}
+}
+
+func toCloudEntities(src []Entity) []datastore.PropertyLoadSaver {
+	pls := make([]datastore.PropertyLoadSaver, len(src))
+	for i, e := range src {
+		pls[i] = &cloudEntity{e}
+	}
+	return pls
+}
+
+func fromCloudError(ctx context.Context, err error) error {
+	err = contextError(ctx, err)
+	switch status.Code(err) {
+	case codes.Aborted, codes.ResourceExhausted:
+		return &TransientError{Err: err}
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return &TransientError{Err: err, Uncertain: true}
+	}
+	if me, ok := err.(datastore.MultiError); ok {
+		for _, err := range me {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrNoSuchEntity
+			}
+		}
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return ErrNoSuchEntity
+	case datastore.ErrConcurrentTransaction:
+		return ErrConcurrentTransaction
+	}
+	return err
 }
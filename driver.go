@@ -0,0 +1,142 @@
+package dfs
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// Driver is the storage backend used by a FileSystem. It mirrors the
+	// subset of the datastore API that the filesystem relies on so that
+	// the path and handle logic can be shared between the standalone and
+	// appengine datastore clients, or any other implementation.
+	Driver interface {
+		// Get loads the entity stored for key into dst, returning
+		// ErrNoSuchEntity if there is no entity for the key
+		Get(ctx context.Context, key *Key, dst Entity) error
+
+		// Put saves the entity src into the datastore with key
+		Put(ctx context.Context, key *Key, src Entity) error
+
+		// PutMulti is a batch version of Put
+		PutMulti(ctx context.Context, keys []*Key, src []Entity) error
+
+		// Delete deletes the entity for the given key
+		Delete(ctx context.Context, key *Key) error
+
+		// DeleteMulti is a batch version of Delete
+		DeleteMulti(ctx context.Context, keys []*Key) error
+
+		// Run runs the given query
+		Run(ctx context.Context, q *Query) Iterator
+
+		// RunInTransaction runs f in a transaction, retrying it if there
+		// is contention with other transactions
+		RunInTransaction(ctx context.Context, f func(tx Transaction) error) error
+	}
+
+	// Transaction represents a set of datastore operations to be
+	// committed atomically
+	Transaction interface {
+		// Get is the transaction-specific version of Driver.Get
+		Get(key *Key, dst Entity) error
+
+		// GetMulti is a batch version of Get, returning ErrNoSuchEntity
+		// if any of the entities do not exist
+		GetMulti(keys []*Key, dst []Entity) error
+
+		// Put is the transaction-specific version of Driver.Put
+		Put(key *Key, src Entity) error
+
+		// PutMulti is the transaction-specific version of Driver.PutMulti
+		PutMulti(keys []*Key, src []Entity) error
+
+		// Delete is the transaction-specific version of Driver.Delete
+		Delete(key *Key) error
+
+		// DeleteMulti is the transaction-specific version of Driver.DeleteMulti
+		DeleteMulti(keys []*Key) error
+	}
+
+	// Iterator is the result of running a query
+	Iterator interface {
+		// Next returns the key of the next result, loading it into dst
+		// unless the query is keys-only. When there are no more results
+		// ErrIteratorDone is returned.
+		Next(dst Entity) (*Key, error)
+
+		// Cursor returns a cursor for the position after the last result
+		// returned by Next which can be used to continue the query
+		Cursor() (string, error)
+	}
+
+	// Entity is implemented by values stored by a Driver, it is the
+	// equivalent of the datastore PropertyLoadSaver interface
+	Entity interface {
+		// Load loads all of the provided properties into the entity
+		Load([]Property) error
+
+		// Save returns all of the entity properties to be stored
+		Save() ([]Property, error)
+	}
+
+	// Property is a name/value pair plus some metadata. The Value can be
+	// an int64, bool, string, float64, []byte or time.Time
+	Property struct {
+		Name    string
+		Value   interface{}
+		NoIndex bool
+	}
+
+	// Key represents the datastore key for a stored entity
+	Key struct {
+		Kind      string
+		Name      string
+		Parent    *Key
+		Namespace string
+	}
+
+	// Query represents a datastore query. Results are always returned
+	// in key order unless an inequality filter is used, in which case
+	// they are ordered by the filtered property first. Start is a cursor
+	// from a previous run of the same query to continue from. If there
+	// is an Ancestor the results are limited to it and its descendants
+	// and are strongly consistent.
+	Query struct {
+		Kind      string
+		Namespace string
+		Ancestor  *Key
+		Filters   []Filter
+		Start     string
+		Offset    int
+		Limit     int
+		KeysOnly  bool
+	}
+
+	// Filter restricts query results to entities where the property
+	// compares to the value using the operator (=, <, <=, > or >=)
+	Filter struct {
+		Property string
+		Operator string
+		Value    interface{}
+	}
+)
+
+var (
+	ErrNoSuchEntity  = errors.New("No such entity")
+	ErrIteratorDone  = errors.New("No more items in iterator")
+	ErrInvalidCursor = errors.New("Invalid cursor")
+
+	ErrConcurrentTransaction = errors.New("Concurrent transaction")
+)
+
+// contextError returns the error of the context if it is done so that an
+// operation that is cancelled or times out returns ctx.Err(), whatever
+// error the datastore client reports for it
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package dfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// KeyProvider protects the per-file data keys used to encrypt file
+	// data, such as a key management service
+	KeyProvider interface {
+		// Wrap encrypts the data key with the current key encryption
+		// key, returning the ID of the key used and the wrapped key
+		Wrap(ctx context.Context, dataKey []byte) (string, []byte, error)
+
+		// Unwrap decrypts a data key wrapped with the identified key,
+		// returning ErrKeyUnavailable if the key can't be used
+		Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+	}
+
+	// staticKeyProvider implements KeyProvider with a fixed set of keys
+	staticKeyProvider struct {
+		current string
+		keys    map[string][]byte
+	}
+)
+
+// encryptionScheme is recorded in the Format followed by the key ID
+const encryptionScheme = "aesgcm"
+
+var (
+	ErrKeyUnavailable = errors.New("Key unavailable")
+
+	errCiphertextTooShort = errors.New("Ciphertext too short")
+	errAlreadyRotated     = errors.New("Already rotated")
+)
+
+// WithEncryption encrypts file data with AES-GCM when it is saved. Each
+// file is encrypted with its own data key which is stored with the file
+// after being wrapped by the key provider.
+func WithEncryption(keys KeyProvider) Option {
+	return func(fs *FileSystem) {
+		fs.keys = keys
+	}
+}
+
+// NewStaticKeyProvider creates a KeyProvider from a set of AES keys (16,
+// 24 or 32 bytes long) by ID, wrapping data keys with the current one
+func NewStaticKeyProvider(current string, keys map[string][]byte) KeyProvider {
+	return &staticKeyProvider{current: current, keys: keys}
+}
+
+func (p *staticKeyProvider) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	key, ok := p.keys[p.current]
+	if !ok {
+		return "", nil, ErrKeyUnavailable
+	}
+	wrapped, err := gcmSeal(key, dataKey)
+	return p.current, wrapped, err
+}
+
+func (p *staticKeyProvider) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, ErrKeyUnavailable
+	}
+	return gcmOpen(key, wrapped)
+}
+
+// encrypt encrypts the data with a new data key
+func (fs *FileSystem) encrypt(fileData *FileData, data []byte) ([]byte, string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	keyID, wrapped, err := fs.keys.Wrap(fs.ctx, dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encrypted, err := gcmSeal(dataKey, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fileData.DataKey = wrapped
+	return encrypted, encryptionScheme + ":" + keyID, nil
+}
+
+// decrypt decrypts the data with the file data key
+func (fs *FileSystem) decrypt(fileData *FileData, keyID string, data []byte) ([]byte, error) {
+	if fs.keys == nil {
+		return nil, ErrKeyUnavailable
+	}
+
+	dataKey, err := fs.keys.Unwrap(fs.ctx, keyID, fileData.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcmOpen(dataKey, data)
+}
+
+// encryptionKeyID returns the ID of the key used if the format is encrypted
+func encryptionKeyID(format string) (string, bool) {
+	if strings.HasPrefix(format, encryptionScheme+":") {
+		return format[len(encryptionScheme)+1:], true
+	}
+	return "", false
+}
+
+// RotateKeys re-wraps the data key of every encrypted file in the
+// filesystem namespace and kind with the current key from the key
+// provider, returning the number of files updated. The file data does
+// not need to be re-encrypted so the old keys can be retired after.
+func (fs *FileSystem) RotateKeys() (_ int, err error) {
+	fs, span := fs.startSpan("RotateKeys", filePathSeparator)
+	defer span.end(&err)
+
+	if fs.keys == nil {
+		return 0, ErrKeyUnavailable
+	}
+
+	q := &Query{
+		Kind:      fs.kind,
+		Namespace: fs.namespace,
+		KeysOnly:  true,
+	}
+
+	count := 0
+	it := fs.driver.Run(fs.ctx, q)
+	for {
+		key, err := it.Next(nil)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		rotated := false
+		err = fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+			rotated = false
+
+			var fileData FileData
+			if err := tx.Get(key, &fileData); err != nil {
+				if err == ErrNoSuchEntity {
+					return nil
+				}
+				return err
+			}
+
+			if err := fs.rewrap(&fileData); err != nil {
+				if err == errAlreadyRotated {
+					return nil
+				}
+				return err
+			}
+
+			rotated = true
+			return tx.Put(key, &fileData)
+		})
+		if err != nil {
+			return count, err
+		}
+		if rotated {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// rewrap wraps the file data key with the current key, returning
+// errAlreadyRotated if the file is not encrypted or already uses it
+func (fs *FileSystem) rewrap(fileData *FileData) error {
+	formats := strings.Split(fileData.Format, formatSeparator)
+	for i, format := range formats {
+		keyID, ok := encryptionKeyID(format)
+		if !ok {
+			continue
+		}
+
+		dataKey, err := fs.keys.Unwrap(fs.ctx, keyID, fileData.DataKey)
+		if err != nil {
+			return err
+		}
+		currentID, wrapped, err := fs.keys.Wrap(fs.ctx, dataKey)
+		if err != nil {
+			return err
+		}
+		if currentID == keyID {
+			return errAlreadyRotated
+		}
+
+		formats[i] = encryptionScheme + ":" + currentID
+		fileData.Format = strings.Join(formats, formatSeparator)
+		fileData.DataKey = wrapped
+		return nil
+	}
+
+	return errAlreadyRotated
+}
+
+// gcmSeal encrypts data using AES-GCM with a random nonce prepended
+func gcmSeal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// gcmOpen decrypts data encrypted by gcmSeal
+func gcmOpen(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errCiphertextTooShort
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,82 @@
+package dfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	data := bytes.Repeat([]byte("Lorem ipsum dolor sit amet. "), 1000)
+
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 32)
+
+	keys := NewStaticKeyProvider("k1", map[string][]byte{"k1": k1})
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithEncryption(keys), WithCompression(Gzip))
+	if err := afero.WriteFile(fs, "/page.md", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/image.png", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var fileData FileData
+	if err := driver.Get(ctx, fs.makeKey("/page.md"), &fileData); err != nil {
+		t.Fatal(err)
+	}
+	if fileData.Format != "gzip+aesgcm:k1" || len(fileData.DataKey) == 0 {
+		t.Errorf("format = %q, data key %d bytes", fileData.Format, len(fileData.DataKey))
+	}
+	if err := driver.Get(ctx, fs.makeKey("/image.png"), &fileData); err != nil {
+		t.Fatal(err)
+	}
+	if fileData.Format != "aesgcm:k1" || bytes.Contains(fileData.encoded, []byte("Lorem ipsum")) {
+		t.Errorf("format = %q, plaintext stored", fileData.Format)
+	}
+
+	// files can't be read without the key
+	for _, fs := range []*FileSystem{
+		NewDriverFileSystem(ctx, driver, "", ""),
+		NewDriverFileSystem(ctx, driver, "", "", WithEncryption(NewStaticKeyProvider("k2", map[string][]byte{"k2": k2}))),
+	} {
+		_, err := afero.ReadFile(fs, "/page.md")
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != ErrKeyUnavailable {
+			t.Errorf("err = %v, want %v", err, ErrKeyUnavailable)
+		}
+	}
+
+	// rotate to the new key, after which the old key isn't needed
+	keys = NewStaticKeyProvider("k2", map[string][]byte{"k1": k1, "k2": k2})
+	fs = NewDriverFileSystem(ctx, driver, "", "", WithEncryption(keys))
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fs.RotateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("rotated %d files, want 2", n)
+	}
+	if n, _ := fs.RotateKeys(); n != 0 {
+		t.Errorf("rotated %d files again, want 0", n)
+	}
+
+	keys = NewStaticKeyProvider("k2", map[string][]byte{"k2": k2})
+	fs = NewDriverFileSystem(ctx, driver, "", "", WithEncryption(keys))
+	for _, name := range []string{"/page.md", "/image.png"} {
+		b, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: data does not match", name)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+// +build appengine
+
+package dfs
+
+import (
+	"errors"
+)
+
+// syscall isn't available on AppEngine Standard so the namespace errors
+// can't be the system errors returned by the os package
+var (
+	ErrNotDirectory      = errors.New("Not a directory")
+	ErrIsDirectory       = errors.New("Is a directory")
+	ErrDirectoryNotEmpty = errors.New("Directory not empty")
+	ErrBadDescriptor     = errors.New("Bad file descriptor")
+)
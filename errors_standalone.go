@@ -0,0 +1,16 @@
+// +build !appengine
+
+package dfs
+
+import (
+	"syscall"
+)
+
+// the namespace errors are the system errors returned by the os package so
+// code can check for them the same way on either filesystem
+var (
+	ErrNotDirectory      error = syscall.ENOTDIR
+	ErrIsDirectory       error = syscall.EISDIR
+	ErrDirectoryNotEmpty error = syscall.ENOTEMPTY
+	ErrBadDescriptor     error = syscall.EBADF
+)
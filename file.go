@@ -5,25 +5,35 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"path/filepath"
-	"sync/atomic"
 
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type (
 	// File represents a file handle within
 	// a datastore filesystem session
 	File struct {
-		// atomic requires 64-bit alignment for struct field access
-		at           int64
-		readDirCount int64
-		closed       bool
-		readOnly     bool
-		fileData     *FileData
-		fs           *FileSystem
+		// mu guards the state of the handle and is always taken before
+		// the lock of the file data, which guards the file data
+		mu            sync.Mutex
+		at            int64
+		readDirCursor string
+		closed        bool
+		lock          *Lock
+
+		// the open flags, which don't change
+		readOnly   bool
+		writeOnly  bool
+		append     bool
+		syncWrites bool
+
+		fileData *FileData
+		fs       *FileSystem
 	}
 )
 
@@ -34,13 +44,27 @@ var (
 	ErrFileClosed        = errors.New("File is closed")
 	ErrOutOfRange        = errors.New("Out of range")
 	ErrTooLarge          = errors.New("Too large")
+	ErrNegativeOffset    = errors.New("Negative offset")
 	ErrFileNotFound      = os.ErrNotExist
 	ErrFileExists        = os.ErrExist
 	ErrDestinationExists = os.ErrExist
 )
 
+// isFailure returns whether the error means an operation failed, rather
+// than that it reached the end of a file or directory
+func isFailure(err error) bool {
+	return err != nil && err != io.EOF
+}
+
 // NewFileHandle initializes a File object
 func NewFileHandle(fs *FileSystem, fileData *FileData) *File {
+	fileData.handles.Add(1)
+	return newFileHandle(fs, fileData)
+}
+
+// newFileHandle initializes a File object for file data that has already
+// counted the handle, when it was pinned as it was looked up in the cache
+func newFileHandle(fs *FileSystem, fileData *FileData) *File {
 	return &File{
 		fs:       fs,
 		fileData: fileData,
@@ -49,71 +73,171 @@ func NewFileHandle(fs *FileSystem, fileData *FileData) *File {
 
 // NewReadOnlyFileHandle initializes a File object
 func NewReadOnlyFileHandle(fs *FileSystem, fileData *FileData) *File {
-	return &File{
-		readOnly: true,
-		fs:       fs,
-		fileData: fileData,
-	}
+	f := NewFileHandle(fs, fileData)
+	f.readOnly = true
+	return f
 }
 
 func (f *File) Open() error {
-	atomic.StoreInt64(&f.at, 0)
-	atomic.StoreInt64(&f.readDirCount, 0)
-	f.fileData.Lock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.at = 0
+	f.readDirCursor = ""
+	if f.closed {
+		f.fileData.handles.Add(1)
+	}
 	f.closed = false
-	f.fileData.Unlock()
 	return nil
 }
 
-func (f *File) Close() error {
-	f.fileData.Lock()
-	defer f.fileData.Unlock()
+func (f *File) Close() (err error) {
+	name := f.Name()
+	fs, span := f.fs.startSpan("Close", name)
+	defer span.end(&err)
+
+	err = f.close(fs)
+	if IsConflict(err) {
+		// the file has to be loaded again to see the other changes, so
+		// the unsaved changes are only kept in the conflict, which is
+		// returned rather than a failure to unlock
+		start := time.Now()
+		if unlockErr := f.unlock(); unlockErr != nil {
+			fs.logOp("Unlock", name, start, unlockErr)
+		}
+		f.fs.cache.remove(name)
+		return err
+	}
+	if err != nil {
+		// the handle is still open so Close can be called again
+		return pathError("close", name, err)
+	}
+
+	// the changes are saved before the lock is released, and the file
+	// data may no longer be pinned in the cache
+	err = f.unlock()
+	f.fs.cache.release(name)
+	return err
+}
+
+// unlock releases the advisory lock of the handle as it's closed, if it
+// holds one
+func (f *File) unlock() error {
+	if err := f.Unlock(); err != nil && err != ErrNotLocked {
+		return err
+	}
+	return nil
+}
+
+// close releases the handle, saving the changes made through any handle
+// when it's the last one open. If the save fails the handle stays open,
+// and the file data dirty, unless the file was changed by another session.
+func (f *File) close(fs *FileSystem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
 
+	// the file data stays pinned while it's saved as it's still dirty
+	var err error
+	if f.fileData.handles.Add(-1) == 0 {
+		err = fs.saveDirty(f.fileData)
+		if err != nil && !IsConflict(err) {
+			f.fileData.handles.Add(1)
+			return err
+		}
+	}
 	f.closed = true
 
-	if f.fileData.dirty {
-		f.fileData.ModTime = time.Now()
-		f.fileData.Size = int64(len(f.fileData.Data))
-		f.fileData.dirty = false
-		return f.fs.saveFileData(f.fileData)
+	return err
+}
+
+// checkRead returns an error if the file wasn't opened for reading
+func (f *File) checkRead(op string) error {
+	if f.writeOnly {
+		return &os.PathError{Op: op, Path: f.Name(), Err: ErrBadDescriptor}
+	}
+	return nil
+}
+
+// checkWrite returns an error if the file wasn't opened for writing
+func (f *File) checkWrite(op string) error {
+	if f.readOnly {
+		return &os.PathError{Op: op, Path: f.Name(), Err: ErrBadDescriptor}
 	}
+	return nil
+}
 
+// syncWrite saves a change straight away if the file was opened with
+// O_SYNC, the caller holds the lock of the handle but not the file data
+func (f *File) syncWrite(fs *FileSystem, op string) error {
+	if !f.syncWrites {
+		return nil
+	}
+	if err := fs.saveDirty(f.fileData); err != nil {
+		return pathError(op, f.Name(), err)
+	}
 	return nil
 }
 
 // Name returns the filename
 func (f *File) Name() string {
+	f.fileData.Lock()
+	defer f.fileData.Unlock()
+
 	return f.fileData.name
 }
 
 func (f *File) Stat() (os.FileInfo, error) {
-	return &FileInfo{f.fileData}, nil
+	return NewFileInfo(f.fileData), nil
 }
 
-func (f *File) Sync() error {
+// Sync saves the changes made through any handle of the file straight
+// away rather than when the last handle is closed
+func (f *File) Sync() (err error) {
+	fs, span := f.fs.startSpan("Sync", f.Name())
+	defer span.end(&err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrFileClosed
+	}
+	if err := fs.saveDirty(f.fileData); err != nil {
+		return pathError("sync", f.Name(), err)
+	}
 	return nil
 }
 
-func (f *File) Readdir(count int) ([]os.FileInfo, error) {
-	logger.Println("Readdir", count, f.readDirCount)
+func (f *File) Readdir(count int) (_ []os.FileInfo, err error) {
+	fs, span := f.fs.startSpan("Readdir", f.Name())
+	defer span.end(&err)
+
+	// the handle is locked while the directory is read so the cursor
+	// isn't used by two calls at once
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	files, err := f.fs.readDir(f.fileData.name, int(f.readDirCount), count)
+	name := f.Name()
+	files, cursor, err := fs.readDir(name, f.readDirCursor, count)
 	if err != nil {
-		return nil, err
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
 	}
 
 	if len(files) == 0 && count > 0 {
 		return nil, io.EOF
 	}
 
-	f.readDirCount += int64(len(files))
+	f.readDirCursor = cursor
+	span.SetAttributes(attribute.Int("dfs.entries", len(files)))
 
 	return files, nil
 }
 
 func (f *File) Readdirnames(n int) ([]string, error) {
-	logger.Println("Readdirnames", n, f.readDirCount)
-
 	fi, err := f.Readdir(n)
 	if err != nil {
 		return nil, err
@@ -125,105 +249,204 @@ func (f *File) Readdirnames(n int) ([]string, error) {
 	return names, err
 }
 
-func (f *File) Read(data []byte) (int, error) {
-	logger.Println("Read", len(data))
+func (f *File) Read(data []byte) (n int, err error) {
+	_, span := f.fs.startSpan("Read", f.Name())
+	defer span.endBytes(&n, &err)
+
+	if err := f.checkRead("read"); err != nil {
+		return 0, err
+	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.fileData.Lock()
 	defer f.fileData.Unlock()
 
 	if f.closed {
 		return 0, ErrFileClosed
 	}
-	if len(data) > 0 && int(f.at) == len(f.fileData.Data) {
+
+	n = f.readAt(data, f.at)
+	f.at += int64(n)
+	if n == 0 && len(data) > 0 {
 		return 0, io.EOF
 	}
+	return n, nil
+}
+
+// ReadAt reads from the offset without changing the offset of the file,
+// so it can be used concurrently with other reads. As for io.ReaderAt it
+// returns io.EOF if it reads fewer bytes than asked for.
+func (f *File) ReadAt(data []byte, off int64) (n int, err error) {
+	_, span := f.fs.startSpan("ReadAt", f.Name())
+	defer span.endBytes(&n, &err)
+
+	if err := f.checkRead("readat"); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.Name(), Err: ErrNegativeOffset}
+	}
 
-	var n int
-	if len(f.fileData.Data)-int(f.at) >= len(data) {
-		n = len(data)
-	} else {
-		n = len(f.fileData.Data) - int(f.at)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fileData.Lock()
+	defer f.fileData.Unlock()
+
+	if f.closed {
+		return 0, ErrFileClosed
 	}
 
-	copy(data, f.fileData.Data[f.at:f.at+int64(n)])
-	atomic.AddInt64(&f.at, int64(n))
+	n = f.readAt(data, off)
+	if n < len(data) {
+		return n, io.EOF
+	}
 	return n, nil
 }
 
-func (f *File) ReadAt(data []byte, off int64) (int, error) {
-	atomic.StoreInt64(&f.at, off)
-	return f.Read(data)
+// readAt copies the data from the offset, the caller holds the lock of the
+// file data
+func (f *File) readAt(data []byte, off int64) int {
+	if off >= int64(len(f.fileData.Data)) {
+		return 0
+	}
+	return copy(data, f.fileData.Data[off:])
 }
 
-func (f *File) Truncate(size int64) error {
-	f.fileData.Lock()
-	defer f.fileData.Unlock()
+func (f *File) Truncate(size int64) (err error) {
+	fs, span := f.fs.startSpan("Truncate", f.Name())
+	defer span.end(&err)
 
-	if f.closed == true {
+	if err := f.checkWrite("truncate"); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
 		return ErrFileClosed
 	}
 	if size < 0 {
 		return ErrOutOfRange
 	}
+
+	f.fileData.Lock()
 	if size > int64(len(f.fileData.Data)) {
 		diff := size - int64(len(f.fileData.Data))
 		f.fileData.Data = append(f.fileData.Data, bytes.Repeat([]byte{00}, int(diff))...)
 	} else {
 		f.fileData.Data = f.fileData.Data[0:size]
 	}
+	f.fileData.Size = size
 	f.fileData.ModTime = time.Now()
-	f.fileData.dirty = true
-	return nil
+	f.fileData.changed()
+	f.fileData.Unlock()
+
+	return f.syncWrite(fs, "truncate")
 }
 
-func (f *File) Seek(offset int64, whence int) (int64, error) {
-	logger.Println("Seek", offset, whence)
+func (f *File) Seek(offset int64, whence int) (_ int64, err error) {
+	_, span := f.fs.startSpan("Seek", f.Name())
+	defer span.end(&err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fileData.Lock()
+	defer f.fileData.Unlock()
 
 	if f.closed {
 		return 0, ErrFileClosed
 	}
+
+	var pos int64
 	switch whence {
-	case 0:
-		atomic.StoreInt64(&f.at, offset)
-	case 1:
-		atomic.AddInt64(&f.at, int64(offset))
-	case 2:
-		atomic.StoreInt64(&f.at, int64(len(f.fileData.Data))+offset)
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.at + offset
+	case io.SeekEnd:
+		pos = int64(len(f.fileData.Data)) + offset
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.fileData.name, Err: os.ErrInvalid}
+	}
+	if pos < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.fileData.name, Err: os.ErrInvalid}
 	}
-	return f.at, nil
+
+	// seeking to the start of a directory reads it again
+	if pos == 0 && f.fileData.Directory {
+		f.readDirCursor = ""
+	}
+	f.at = pos
+	return pos, nil
 }
 
-func (f *File) Write(data []byte) (int, error) {
-	logger.Println("Write", len(data))
+func (f *File) Write(data []byte) (n int, err error) {
+	fs, span := f.fs.startSpan("Write", f.Name())
+	defer span.endBytes(&n, &err)
+
+	if err := f.checkWrite("write"); err != nil {
+		return 0, err
+	}
 
-	n := len(data)
-	cur := atomic.LoadInt64(&f.at)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, ErrFileClosed
+	}
 
 	f.fileData.Lock()
-	defer f.fileData.Unlock()
+	// files opened with O_APPEND are always written at the end
+	if f.append {
+		f.at = int64(len(f.fileData.Data))
+	}
+	n = f.writeAt(data, f.at)
+	f.fileData.Unlock()
+	f.at += int64(n)
+
+	return n, f.syncWrite(fs, "write")
+}
+
+// WriteAt writes at the offset without changing the offset of the file
+func (f *File) WriteAt(data []byte, off int64) (n int, err error) {
+	fs, span := f.fs.startSpan("WriteAt", f.Name())
+	defer span.endBytes(&n, &err)
 
-	diff := cur - int64(len(f.fileData.Data))
-	var tail []byte
-	if n+int(cur) < len(f.fileData.Data) {
-		tail = f.fileData.Data[n+int(cur):]
+	if err := f.checkWrite("writeat"); err != nil {
+		return 0, err
 	}
-	if diff > 0 {
-		f.fileData.Data = append(bytes.Repeat([]byte{00}, int(diff)), data...)
-		f.fileData.Data = append(f.fileData.Data, tail...)
-	} else {
-		f.fileData.Data = append(f.fileData.Data[:cur], data...)
-		f.fileData.Data = append(f.fileData.Data, tail...)
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.Name(), Err: ErrNegativeOffset}
 	}
-	atomic.StoreInt64(&f.at, int64(len(f.fileData.Data)))
-	f.fileData.ModTime = time.Now()
-	f.fileData.dirty = true
 
-	return n, nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, ErrFileClosed
+	}
+
+	f.fileData.Lock()
+	n = f.writeAt(data, off)
+	f.fileData.Unlock()
+
+	return n, f.syncWrite(fs, "writeat")
 }
 
-func (f *File) WriteAt(data []byte, off int64) (int, error) {
-	atomic.StoreInt64(&f.at, off)
-	return f.Write(data)
+// writeAt copies the data to the offset, filling any gap after the end of
+// the file with zeros. The caller holds the lock of the file data.
+func (f *File) writeAt(data []byte, off int64) int {
+	if end := off + int64(len(data)); end > int64(len(f.fileData.Data)) {
+		f.fileData.Data = append(f.fileData.Data, make([]byte, end-int64(len(f.fileData.Data)))...)
+	}
+	n := copy(f.fileData.Data[off:], data)
+
+	f.fileData.Size = int64(len(f.fileData.Data))
+	f.fileData.ModTime = time.Now()
+	f.fileData.changed()
+	return n
 }
 
 func (f *File) WriteString(s string) (ret int, err error) {
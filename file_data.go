@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"path/filepath"
+	"sync/atomic"
 )
 
 type (
@@ -15,11 +16,34 @@ type (
 		// used if two file handles have the same file loaded
 		sync.Mutex
 
+		// save is held while the file data is saved, which is done without
+		// the lock, so saves of the file are made one at a time. It's
+		// always taken before the lock.
+		save sync.Mutex
+
+		// number of changes, so a save can tell if the file data was
+		// changed while it was being saved
+		changes int64
+
+		// whether the file was removed, so handles that are still open
+		// don't save it again
+		removed bool
+
 		// identity of this entity
 		name string
 
-		// whether the data is dirty
-		dirty bool
+		// whether the data is dirty, which pins it in the session cache
+		dirty atomic.Bool
+
+		// number of open file handles, which pin it in the session cache
+		handles atomic.Int32
+
+		// size of the data held in memory, set by measure for the session
+		// cache to read without taking the lock
+		size atomic.Int64
+
+		// the Data encoded in Format as it is stored
+		encoded []byte
 
 		// Mode is the filemode / permission flags
 		Mode int64 `datastore:"mode,noindex"`
@@ -33,31 +57,63 @@ type (
 		// Format of Data (to support compression, encryption etc...)
 		Format string `datastore:"format"`
 
+		// DataKey is the wrapped key the Data is encrypted with
+		DataKey []byte `datastore:"data_key,noindex"`
+
 		// Size in bytes of the data
 		Size int64 `datastore:"size"`
 
-		// Data in Format specified
+		// Data is the file content, stored in the Format specified
 		Data []byte `datastore:"data,noindex"`
 
-		// File is the GCS file, used to store the Data if the file
-		// is too large to be stored directly in datastore (1Mb limit)
-		// File string `datastore:"file"`
+		// Chunks is the number of chunk entities the Data is split into
+		// if it is too large to be stored in the file entity (1Mb limit)
+		Chunks int64 `datastore:"chunks,noindex"`
+
+		// Blob is the name of the blob used to store the Data if the
+		// file is too large to be stored directly in datastore
+		Blob string `datastore:"blob,noindex"`
+
+		// Checksum is the SHA-256 of the encoded Data stored in the Blob
+		Checksum string `datastore:"checksum,noindex"`
+
+		// Content is the SHA-256 of the encoded Data if it is stored as
+		// shared content rather than with the file
+		Content string `datastore:"content,noindex"`
 
 		// ModTime is the last modification time
 		ModTime time.Time `datastore:"mod_time"`
+
+		// Generation is incremented each time the file is saved so that
+		// changes made by other sessions can be detected
+		Generation int64 `datastore:"generation,noindex"`
+
+		// AccessTime is the last access time, only set by Chtimes
+		AccessTime time.Time `datastore:"access_time,noindex"`
 	}
 )
 
+const (
+	// DefaultFileMode is the mode new files are created with
+	// before the FileSystem umask is applied
+	DefaultFileMode os.FileMode = 0666
+
+	// DefaultDirMode is the mode new directories are created with
+	// before the FileSystem umask is applied
+	DefaultDirMode os.FileMode = 0777
+)
+
 // CreateFile creates a new file
 func CreateFile(name string) *FileData {
-	return &FileData{
+	fd := &FileData{
 		name:    name,
-		dirty:   true,
 		Parent:  filepath.Dir(name),
-		Mode:    int64(os.ModeTemporary),
+		Mode:    int64(DefaultFileMode),
 		ModTime: time.Now(),
 		Data:    make([]byte, 0),
 	}
+	fd.dirty.Store(true)
+	return fd
 }
 
 // CreateDir creates a new directory
@@ -65,9 +121,146 @@ func CreateDir(name string) *FileData {
 	return &FileData{
 		name:      name,
 		Parent:    filepath.Dir(name),
-		Mode:      int64(os.ModeDir),
+		Mode:      int64(os.ModeDir | DefaultDirMode),
 		ModTime:   time.Now(),
 		Data:      make([]byte, 0),
 		Directory: true,
 	}
 }
+
+// measure records the size of the data and encoded data for the session
+// cache, the caller holds the lock if the file data is shared
+func (fd *FileData) measure() {
+	fd.size.Store(int64(len(fd.Data) + len(fd.encoded)))
+}
+
+// changed records that the file data has unsaved changes, the caller
+// holds the lock
+func (fd *FileData) changed() {
+	fd.changes++
+	fd.dirty.Store(true)
+	fd.measure()
+}
+
+// snapshot returns a copy of the file data that can be saved without the
+// lock, which the caller holds
+func (fd *FileData) snapshot() *FileData {
+	return &FileData{
+		name:       fd.name,
+		Mode:       fd.Mode,
+		Directory:  fd.Directory,
+		Parent:     fd.Parent,
+		Size:       int64(len(fd.Data)),
+		Data:       append(make([]byte, 0, len(fd.Data)), fd.Data...),
+		ModTime:    fd.ModTime,
+		Generation: fd.Generation,
+		AccessTime: fd.AccessTime,
+	}
+}
+
+// saved updates the file data from the snapshot after it was saved, so it
+// is at the new generation, and is only clean if it hasn't been changed
+// since the snapshot was taken. The caller holds the lock.
+func (fd *FileData) saved(snapshot *FileData, changes int64) {
+	fd.Format = snapshot.Format
+	fd.DataKey = snapshot.DataKey
+	fd.Chunks = snapshot.Chunks
+	fd.Blob = snapshot.Blob
+	fd.Checksum = snapshot.Checksum
+	fd.Content = snapshot.Content
+	fd.Generation = snapshot.Generation
+	if fd.changes == changes {
+		fd.encoded = snapshot.encoded
+		fd.dirty.Store(false)
+	}
+	fd.measure()
+}
+
+// remove marks the file data as removed, discarding any unsaved changes,
+// once a save that is in progress has finished
+func (fd *FileData) remove() {
+	fd.save.Lock()
+	defer fd.save.Unlock()
+	fd.Lock()
+	defer fd.Unlock()
+
+	fd.removed = true
+	fd.dirty.Store(false)
+}
+
+// implements Entity
+var _ Entity = (*FileData)(nil)
+
+// Load loads the datastore properties into the FileData
+func (fd *FileData) Load(props []Property) error {
+	// the data is only saved when it isn't chunked, in a blob or shared
+	fd.encoded = nil
+	fd.Chunks = 0
+	fd.Blob = ""
+	fd.Checksum = ""
+	fd.Content = ""
+
+	for _, p := range props {
+		switch p.Name {
+		case "mode":
+			fd.Mode, _ = p.Value.(int64)
+		case "dir":
+			fd.Directory, _ = p.Value.(bool)
+		case "parent":
+			fd.Parent, _ = p.Value.(string)
+		case "format":
+			fd.Format, _ = p.Value.(string)
+		case "data_key":
+			fd.DataKey, _ = p.Value.([]byte)
+		case "size":
+			fd.Size, _ = p.Value.(int64)
+		case "data":
+			fd.encoded, _ = p.Value.([]byte)
+		case "chunks":
+			fd.Chunks, _ = p.Value.(int64)
+		case "blob":
+			fd.Blob, _ = p.Value.(string)
+		case "checksum":
+			fd.Checksum, _ = p.Value.(string)
+		case "content":
+			fd.Content, _ = p.Value.(string)
+		case "mod_time":
+			fd.ModTime, _ = p.Value.(time.Time)
+		case "access_time":
+			fd.AccessTime, _ = p.Value.(time.Time)
+		case "generation":
+			fd.Generation, _ = p.Value.(int64)
+		}
+	}
+	return nil
+}
+
+// Save returns the datastore properties for the FileData
+func (fd *FileData) Save() ([]Property, error) {
+	props := []Property{
+		{Name: "mode", Value: fd.Mode, NoIndex: true},
+		{Name: "dir", Value: fd.Directory, NoIndex: true},
+		{Name: "parent", Value: fd.Parent},
+		{Name: "format", Value: fd.Format},
+		{Name: "data_key", Value: fd.DataKey, NoIndex: true},
+		{Name: "size", Value: fd.Size},
+		{Name: "mod_time", Value: fd.ModTime},
+		{Name: "access_time", Value: fd.AccessTime, NoIndex: true},
+		{Name: "generation", Value: fd.Generation, NoIndex: true},
+	}
+
+	// shared, chunked or blob data is stored separately
+	switch {
+	case fd.Content != "":
+		props = append(props, Property{Name: "content", Value: fd.Content, NoIndex: true})
+	case fd.Blob != "":
+		props = append(props,
+			Property{Name: "blob", Value: fd.Blob, NoIndex: true},
+			Property{Name: "checksum", Value: fd.Checksum, NoIndex: true})
+	case fd.Chunks > 0:
+		props = append(props, Property{Name: "chunks", Value: fd.Chunks, NoIndex: true})
+	default:
+		props = append(props, Property{Name: "data", Value: fd.encoded, NoIndex: true})
+	}
+	return props, nil
+}
@@ -7,7 +7,8 @@ import (
 	"path/filepath"
 )
 
-// FileInfo implements os.FileInfo for a file in a datastore filesystem
+// FileInfo implements os.FileInfo for a file in a datastore filesystem,
+// reading the file data under its lock as it may be open and changing
 type FileInfo struct {
 	fileData *FileData
 }
@@ -22,29 +23,44 @@ func NewFileInfo(fileData *FileData) *FileInfo {
 
 // Name is the base name of the file
 func (fi FileInfo) Name() string {
+	fi.fileData.Lock()
+	defer fi.fileData.Unlock()
+
 	return filepath.Base(fi.fileData.name)
 }
 
 // Size is the length in bytes
 func (fi FileInfo) Size() int64 {
+	fi.fileData.Lock()
+	defer fi.fileData.Unlock()
+
 	if fi.fileData.Directory {
 		return int64(42)
 	}
-	return int64(len(fi.fileData.Data))
+	return fi.fileData.Size
 }
 
 // Mode is the file mode bits
 func (fi FileInfo) Mode() os.FileMode {
+	fi.fileData.Lock()
+	defer fi.fileData.Unlock()
+
 	return os.FileMode(fi.fileData.Mode)
 }
 
 // ModTime is the last modification time
 func (fi FileInfo) ModTime() time.Time {
+	fi.fileData.Lock()
+	defer fi.fileData.Unlock()
+
 	return fi.fileData.ModTime
 }
 
 // IsDir is whether the file represents a directory
 func (fi FileInfo) IsDir() bool {
+	fi.fileData.Lock()
+	defer fi.fileData.Unlock()
+
 	return fi.fileData.Directory
 }
 
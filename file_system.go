@@ -1,101 +1,291 @@
 package dfs
 
 import (
-	"fmt"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"path/filepath"
 
 	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type (
+	// FileSystem represents a datastore
+	// backed filesystem session
+	FileSystem struct {
+		mu        *sync.RWMutex
+		ctx       context.Context
+		driver    Driver
+		namespace string
+		kind      string
+		cache     *fileCache
+		umask     os.FileMode
+
+		blobs         BlobStore
+		blobThreshold int64
+
+		codec Codec
+		skip  map[string]bool
+
+		keys KeyProvider
+
+		dedup            bool
+		contentNamespace string
+
+		lockTTL time.Duration
+
+		ancestorKeys bool
+
+		retry *RetryPolicy
+
+		tracer trace.Tracer
+
+		metrics *Collector
+
+		strict bool
+
+		log *slog.Logger
+	}
+
+	// Option configures optional FileSystem behaviour
+	Option func(*FileSystem)
 )
 
 const (
 	filePathSeparator = string(filepath.Separator)
+
+	// DefaultUmask is the umask applied to the mode of new files and
+	// directories unless another is set using WithUmask
+	DefaultUmask os.FileMode = 022
+
+	// chmodMask is the mode bits that can be changed by Chmod
+	chmodMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
 )
 
 var _ afero.Fs = (*FileSystem)(nil)
 
+// NewDriverFileSystem creates a new filesystem backed by the storage driver
+func NewDriverFileSystem(ctx context.Context, driver Driver, namespace, kind string, opts ...Option) *FileSystem {
+	if kind == "" {
+		kind = "file"
+	}
+
+	fs := &FileSystem{
+		mu:        &sync.RWMutex{},
+		ctx:       ctx,
+		driver:    driver,
+		namespace: namespace,
+		kind:      kind,
+		cache:     newFileCache(DefaultCacheEntries, DefaultCacheBytes),
+		umask:     DefaultUmask,
+		lockTTL:   DefaultLockTTL,
+	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	if fs.log == nil {
+		fs.log = slog.New(&legacyHandler{})
+	}
+	fs.log = fs.log.With("namespace", namespace, "kind", kind)
+	fs.log.Debug("create filesystem")
+
+	if fs.tracer != nil {
+		fs.driver = &tracingDriver{Driver: fs.driver, tracer: fs.tracer}
+	}
+	if fs.metrics != nil {
+		fs.driver = &metricsDriver{Driver: fs.driver, c: fs.metrics, namespace: namespace, kind: kind}
+		fs.metrics.add(fs)
+	}
+	if fs.retry != nil {
+		fs.driver = &retryDriver{Driver: fs.driver, policy: *fs.retry, log: fs.log}
+	}
+
+	return fs
+}
+
+// WithContext returns a view of the filesystem that uses the context for
+// the datastore operations it makes, so they can be cancelled or given a
+// deadline. The view shares the session cache and options of the original
+// and files opened through it use the context until they are closed. When
+// the context is done, operations return its error in an os.PathError.
+func (fs *FileSystem) WithContext(ctx context.Context) *FileSystem {
+	view := *fs
+	view.ctx = ctx
+	return &view
+}
+
+// Context returns the context used for the datastore operations
+func (fs *FileSystem) Context() context.Context {
+	return fs.ctx
+}
+
+// WithUmask sets the umask applied to the mode of new files and
+// directories, replacing the DefaultUmask
+func WithUmask(umask os.FileMode) Option {
+	return func(fs *FileSystem) {
+		fs.umask = umask & os.ModePerm
+	}
+}
+
 // Create creates a file in the filesystem, returning the file and an
 // error, if any happens.
-func (fs *FileSystem) Create(name string) (afero.File, error) {
-	logger.Println("Create", name)
+func (fs *FileSystem) Create(name string) (_ afero.File, err error) {
+	fs, span := fs.startSpan("Create", name)
+	defer span.end(&err)
+
+	return fs.create(name, DefaultFileMode)
+}
+
+func (fs *FileSystem) create(name string, perm os.FileMode) (afero.File, error) {
+	name = normalizePath(name)
+
+	existing, err := fs.open(name)
+	if err == nil && existing.Directory {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDirectory}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, pathError("open", name, err)
+	}
+
+	if err := fs.makeParent("open", name); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	fileData := CreateFile(name)
+	fileData.Mode = int64(fs.applyUmask(perm))
+	f := NewFileHandle(fs, fileData)
+	fs.cache.add(name, fileData)
+	fs.mu.Unlock()
+
+	return f, nil
+}
+
+// createExcl creates a file for O_EXCL, saving it in a transaction that
+// fails if the file already exists so only one session can create it
+func (fs *FileSystem) createExcl(name string, perm os.FileMode) (afero.File, error) {
 	name = normalizePath(name)
-	path := filepath.Dir(name)
 
-	if err := fs.MkdirAll(path, os.ModeDir); err != nil {
-		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	if err := fs.makeParent("open", name); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// a new file may only be in the session cache
+	_, ok := fs.cache.get(name, false)
+	fs.traceCache(name, ok)
+	if ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrFileExists}
 	}
 
-	fs.Lock()
 	fileData := CreateFile(name)
-	fs.data[name] = fileData
-	fs.Unlock()
+	fileData.Mode = int64(fs.applyUmask(perm))
+	fileData.dirty.Store(false)
+	if err := fs.saveFileDataIf(fileData, 0); err != nil {
+		if IsConflict(err) || err == ErrIsDirectory {
+			err = ErrFileExists
+		}
+		return nil, pathError("open", name, err)
+	}
+	f := NewFileHandle(fs, fileData)
+	fs.cache.add(name, fileData)
 
-	return NewFileHandle(fs, fileData), nil
+	return f, nil
 }
 
 // Mkdir creates a directory in the filesystem, return an error if any
 // happens.
-func (fs *FileSystem) Mkdir(name string, perm os.FileMode) error {
-	logger.Println("Mkdir", name)
-	clean := filepath.Clean(name)
+func (fs *FileSystem) Mkdir(name string, perm os.FileMode) (err error) {
+	fs, span := fs.startSpan("Mkdir", name)
+	defer span.end(&err)
 
-	fs.RLock()
-	fileData, ok := fs.data[clean]
-	fs.RUnlock()
+	clean := normalizePath(name)
 
-	if ok {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if clean == filePathSeparator {
 		return &os.PathError{Op: "mkdir", Path: name, Err: ErrFileExists}
 	}
+	_, err = fs.open(clean)
+	if err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: ErrFileExists}
+	}
+	if !os.IsNotExist(err) {
+		return pathError("mkdir", name, err)
+	}
+	if err := fs.checkParent("mkdir", clean); err != nil {
+		if fs.strict || !os.IsNotExist(err) {
+			return err
+		}
+	}
 
-	fs.Lock()
-	defer fs.Unlock()
-
-	fileData = CreateDir(clean)
-	fileData.Mode = int64(perm)
+	fileData := CreateDir(clean)
+	fileData.Mode = int64(os.ModeDir | fs.applyUmask(perm))
 
-	if err := fs.saveFileData(fileData); err != nil {
+	// it fails if another session has saved a file since it was checked
+	if err := fs.saveFileDataIf(fileData, 0); err != nil {
+		if IsConflict(err) {
+			err = ErrFileExists
+		}
 		return &os.PathError{Op: "mkdir", Path: name, Err: err}
 	}
 
-	fs.data[clean] = fileData
+	fs.cache.add(clean, fileData)
 
 	return nil
 }
 
 // MkdirAll creates a directory path and all parents that does not exist
 // yet.
-func (fs *FileSystem) MkdirAll(path string, perm os.FileMode) error {
-	logger.Println("MkdirAll", path)
+func (fs *FileSystem) MkdirAll(path string, perm os.FileMode) (err error) {
+	fs, span := fs.startSpan("MkdirAll", path)
+	defer span.end(&err)
+
 	clean := filepath.Clean(path)
 
-	fs.Lock()
-	defer fs.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// an existing directory is left as it is
+	if dir, err := fs.open(clean); err == nil {
+		if !dir.Directory {
+			return &os.PathError{Op: "mkdir", Path: clean, Err: ErrNotDirectory}
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return pathError("mkdir", clean, err)
+	}
 
 	// walk the tree up to the root until we reach a directory
 	create := make([]string, 0)
-	var err error
 	var dir *FileData
 	curr := clean
 	for len(curr) > 1 {
 		curr = filepath.Dir(curr)
-		dir, err = fs.lockfreeOpen(curr)
+		dir, err = fs.open(curr)
 		if err == nil {
 			break
 		}
 		if !os.IsNotExist(err) {
-			return err
+			return pathError("mkdir", curr, err)
 		}
 
-		logger.Println("create", curr)
 		create = append(create, curr)
 	}
 
 	// if we found a parent, it has to be a directory
 	if dir != nil && !dir.Directory {
-		logger.Println("not a dir parent")
-		return ErrFileNotFound // TODO: better error
+		return &os.PathError{Op: "mkdir", Path: curr, Err: ErrNotDirectory}
 	}
 
 	create = append(create, clean)
@@ -103,55 +293,70 @@ func (fs *FileSystem) MkdirAll(path string, perm os.FileMode) error {
 	files := make([]*FileData, count)
 	for i := 0; i < count; i++ {
 		fileData := CreateDir(create[i])
-		fileData.Mode = int64(perm)
+		fileData.Mode = int64(os.ModeDir | fs.applyUmask(perm))
 
 		files[i] = fileData
-		fs.data[create[i]] = fileData
 	}
 
 	if err := fs.saveFileDataMulti(files); err != nil {
 		return &os.PathError{Op: "mkdirall", Path: clean, Err: err}
 	}
+	for _, fileData := range files {
+		fs.cache.add(fileData.name, fileData)
+	}
 	return nil
 }
 
 // Open opens a file, returning it or an error, if any happens.
-func (fs *FileSystem) Open(name string) (afero.File, error) {
-	logger.Println("Open", name)
+func (fs *FileSystem) Open(name string) (_ afero.File, err error) {
+	fs, span := fs.startSpan("Open", name)
+	defer span.end(&err)
 
-	fileData, err := fs.open(name)
+	fileData, err := fs.lookup(name, true)
 	if err != nil {
-		return nil, err
+		return nil, pathError("open", name, err)
 	}
 
-	return NewReadOnlyFileHandle(fs, fileData), nil
+	f := newFileHandle(fs, fileData)
+	f.readOnly = true
+	return f, nil
 }
 
 // OpenFile opens a file using the given flags and the given mode.
-func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
-	logger.Println("OpenFile", name)
-	chmod := false
-	file, err := fs.openWrite(name)
-	if os.IsNotExist(err) && (flag&os.O_CREATE > 0) {
-		file, err = fs.Create(name)
-		chmod = true
+func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (_ afero.File, err error) {
+	fs, span := fs.startSpan("OpenFile", name)
+	defer span.end(&err)
+
+	var file afero.File
+	if flag&os.O_CREATE > 0 && flag&os.O_EXCL > 0 {
+		file, err = fs.createExcl(name, perm)
+	} else {
+		file, err = fs.openWrite(name)
+		if os.IsNotExist(err) && (flag&os.O_CREATE > 0) {
+			file, err = fs.create(name, perm)
+		}
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, pathError("open", name, err)
 	}
-
-	if flag == os.O_RDONLY {
-		file = NewReadOnlyFileHandle(fs, file.(*File).fileData)
+	if file.(*File).fileData.Directory && flag&(os.O_RDWR|os.O_WRONLY) > 0 {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDirectory}
 	}
 
-	if flag&os.O_APPEND > 0 {
-		_, err = file.Seek(0, os.SEEK_END)
-		if err != nil {
-			file.Close()
-			return nil, err
-		}
+	// the access mode is one of O_RDONLY, O_WRONLY or O_RDWR
+	f := file.(*File)
+	switch {
+	case flag&os.O_RDWR > 0:
+	case flag&os.O_WRONLY > 0:
+		f.writeOnly = true
+	default:
+		f.readOnly = true
 	}
+	f.append = flag&os.O_APPEND > 0
+	f.syncWrites = flag&os.O_SYNC > 0
+
 	if flag&os.O_TRUNC > 0 && flag&(os.O_RDWR|os.O_WRONLY) > 0 {
 		err = file.Truncate(0)
 		if err != nil {
@@ -159,29 +364,38 @@ func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (afero.F
 			return nil, err
 		}
 	}
-	if chmod {
-		fs.Chmod(name, perm)
-	}
 
 	return file, nil
 }
 
 // Remove removes a file identified by name, returning an error, if any
 // happens.
-func (fs *FileSystem) Remove(name string) error {
-	logger.Println("Remove", name)
+func (fs *FileSystem) Remove(name string) (err error) {
+	fs, span := fs.startSpan("Remove", name)
+	defer span.end(&err)
+
 	name = normalizePath(name)
 
-	_, err := fs.open(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fileData, err := fs.open(name)
 	if err != nil {
-		return err
-		// &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+		return pathError("remove", name, err)
+	}
+	if fileData.Directory {
+		empty, err := fs.isEmptyDir(name)
+		if err != nil {
+			return pathError("remove", name, err)
+		}
+		if !empty {
+			return &os.PathError{Op: "remove", Path: name, Err: ErrDirectoryNotEmpty}
+		}
 	}
 
-	fs.Lock()
-	defer fs.Unlock()
-
-	delete(fs.data, name)
+	// open handles mustn't save the file again
+	fileData.remove()
+	fs.cache.remove(name)
 
 	if err := fs.deleteFileData(name); err != nil {
 		return &os.PathError{Op: "remove", Path: name, Err: err}
@@ -193,104 +407,221 @@ func (fs *FileSystem) Remove(name string) error {
 // RemoveAll removes a directory path and any children it contains. It
 // does not fail if the path does not exist (return nil).
 func (fs *FileSystem) RemoveAll(path string) error {
-	logger.Println("Remove", path)
+	return fs.RemoveAllFunc(path, nil)
+}
+
+// RemoveAllFunc removes a directory path and any children it contains in
+// batches, calling progress with the number of files removed so far after
+// each one. It does not fail if the path does not exist (return nil).
+func (fs *FileSystem) RemoveAllFunc(path string, progress func(removed int)) (err error) {
+	fs, span := fs.startSpan("RemoveAll", path)
+	defer span.end(&err)
+
 	path = normalizePath(path)
 
-	_, err := fs.open(path)
+	_, err = fs.open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	fs.Lock()
-	defer fs.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// files loaded while they are being removed are invalidated after
+	defer fs.removeCached(path)
+	fs.removeCached(path)
+
+	if err := fs.removeAllDescendents(path, progress); err != nil {
+		return &os.PathError{Op: "removeall", Path: path, Err: err}
+	}
+	return nil
+}
 
-	return fs.removeAllDescendents(path)
+// removeCached removes the named file and everything below it from the
+// session cache, marking them as removed so open handles don't save them
+func (fs *FileSystem) removeCached(name string) {
+	for _, fileData := range fs.cache.removeAll(name) {
+		fileData.remove()
+	}
 }
 
 // Rename renames a file.
-func (fs *FileSystem) Rename(oldname, newname string) error {
+func (fs *FileSystem) Rename(oldname, newname string) (err error) {
+	fs, span := fs.startSpan("Rename", oldname)
+	span.SetAttributes(attribute.String("dfs.new_path", newname))
+	defer span.end(&err)
+
 	oldname = normalizePath(oldname)
 	newname = normalizePath(newname)
 
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// renaming a file to itself only checks that it exists
 	if oldname == newname {
+		if _, err := fs.open(oldname); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: openErr(err)}
+		}
 		return nil
 	}
 
-	// TODO: lookup in memory, remove when rename completed
-	return fs.rename(oldname, newname)
+	src, err := fs.checkRename(oldname, newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	// a new file may only be in the session cache, so it's saved to be
+	// moved along with any other changes to it
+	if err := fs.saveDirty(src); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: openErr(err)}
+	}
+
+	rename := fs.rename
+	if src.Directory {
+		rename = fs.renameDir
+	}
+	loaded, generation, err := rename(oldname, newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	fs.cache.rename(oldname, newname, loaded, generation)
+	return nil
 }
 
 // Stat returns a FileInfo describing the named file, or an error, if any
 // happens.
-func (fs *FileSystem) Stat(name string) (os.FileInfo, error) {
-	logger.Println("Stat", name)
+func (fs *FileSystem) Stat(name string) (_ os.FileInfo, err error) {
+	fs, span := fs.startSpan("Stat", name)
+	defer span.end(&err)
+
 	fileData, err := fs.open(name)
 	if err != nil {
-		return nil, err
+		return nil, pathError("stat", name, err)
 	}
 
 	return NewFileInfo(fileData), nil
 }
 
+// IterDir calls fn for each file in the named directory, streaming them
+// rather than reading the whole directory first. Iteration stops at the
+// first error returned by fn, which is then returned.
+func (fs *FileSystem) IterDir(name string, fn func(os.FileInfo) error) (err error) {
+	fs, span := fs.startSpan("IterDir", name)
+	defer span.end(&err)
+
+	name = normalizePath(name)
+
+	fileData, err := fs.open(name)
+	if err != nil {
+		return pathError("readdir", name, err)
+	}
+	if !fileData.Directory {
+		return &os.PathError{Op: "readdir", Path: name, Err: ErrNotDirectory}
+	}
+
+	var fnErr error
+	_, err = fs.iterDir(name, "", 0, func(fi os.FileInfo) error {
+		fnErr = fn(fi)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return nil
+}
+
 // Name is the name of this FileSystem
 func (fs *FileSystem) Name() string {
 	return "Datastore Fs"
 }
 
 // Chmod changes the mode of the named file to mode.
-func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
-	logger.Println("fs Chmod")
-	return fmt.Errorf("not implemented")
+func (fs *FileSystem) Chmod(name string, mode os.FileMode) (err error) {
+	fs, span := fs.startSpan("Chmod", name)
+	defer span.end(&err)
+
+	return fs.updateFileData("chmod", name, func(fileData *FileData) {
+		fileData.Mode = int64(os.FileMode(fileData.Mode)&^chmodMask | mode&chmodMask)
+	})
 }
 
 // Chtimes changes the access and modification times of the named file
-func (fs *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	logger.Println("fsChtimesMkdir")
-	return fmt.Errorf("not implemented")
+func (fs *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	fs, span := fs.startSpan("Chtimes", name)
+	defer span.end(&err)
+
+	return fs.updateFileData("chtimes", name, func(fileData *FileData) {
+		fileData.AccessTime = atime
+		fileData.ModTime = mtime
+	})
 }
 
-func (fs *FileSystem) openWrite(name string) (afero.File, error) {
-	f, err := fs.open(name)
-	if err != nil {
-		return nil, err
+// Flush saves the changes to every file in the session cache, such as
+// those with open handles, without waiting for them to be closed. A file
+// that fails to save stays dirty and the first error is returned.
+func (fs *FileSystem) Flush() (err error) {
+	fs, span := fs.startSpan("Flush", filePathSeparator)
+	defer span.end(&err)
+
+	for _, fileData := range fs.cache.dirtyFiles() {
+		fileData.Lock()
+		name := fileData.name
+		fileData.Unlock()
+
+		saveErr := fs.saveDirty(fileData)
+		if saveErr != nil && err == nil {
+			err = pathError("flush", name, saveErr)
+		}
 	}
-	return NewFileHandle(fs, f), err
+	return err
 }
 
-func (fs *FileSystem) open(name string) (*FileData, error) {
-	logger.Println("open", name)
-	name = normalizePath(name)
-
-	fs.RLock()
-	fileData, ok := fs.data[name]
-	fs.RUnlock()
-
-	if ok {
-		return fileData, nil
-	}
+// applyUmask returns the permission bits of the mode with the umask removed
+func (fs *FileSystem) applyUmask(perm os.FileMode) os.FileMode {
+	return perm & os.ModePerm &^ fs.umask
+}
 
-	fileData, err := fs.loadFileData(name)
+func (fs *FileSystem) openWrite(name string) (afero.File, error) {
+	f, err := fs.lookup(name, true)
 	if err != nil {
 		return nil, err
 	}
-	fs.data[name] = fileData
-	return fileData, nil
+	return newFileHandle(fs, f), err
+}
+
+func (fs *FileSystem) open(name string) (*FileData, error) {
+	return fs.lookup(name, false)
 }
 
-func (fs *FileSystem) lockfreeOpen(name string) (*FileData, error) {
+// lookup returns the file data from the session cache, loading it if it
+// isn't cached. If pin is set it's for a new file handle, which is counted
+// at the same time so the file data can't be evicted before it's created.
+func (fs *FileSystem) lookup(name string, pin bool) (*FileData, error) {
 	name = normalizePath(name)
-	fileData, ok := fs.data[name]
 
+	fileData, ok := fs.cache.get(name, pin)
+	fs.traceCache(name, ok)
 	if ok {
 		return fileData, nil
 	}
 
-	fileData, err := fs.loadFileData(name)
-	if err != nil {
-		return nil, err
-	}
-	fs.data[name] = fileData
-	return fileData, nil
+	return fs.cache.load(name, pin, func() (*FileData, error) {
+		fileData, err := fs.loadFileData(name)
+		if err == ErrFileNotFound && name == filePathSeparator {
+			// the root always exists, it is saved the first time it is needed
+			fileData = CreateDir(name)
+			fileData.Mode = int64(os.ModeDir | fs.applyUmask(DefaultDirMode))
+			err = fs.saveFileDataMulti([]*FileData{fileData})
+		}
+		return fileData, err
+	})
 }
 
 func hasTrailingSlash(path string) bool {
@@ -3,6 +3,7 @@
 package dfs
 
 import (
+	"flag"
 	"os"
 	"testing"
 
@@ -15,17 +16,25 @@ import (
 
 var (
 	fs afero.Fs
+
+	project     = flag.String("project", "", "datastore project to test against, the in-memory driver is used if not set")
+	credentials = flag.String("credentials", "service-account.json", "service account file for the datastore project")
 )
 
 func TestMain(m *testing.M) {
+	flag.Parse()
 	// Verbose()
 
-	client, err := datastore.NewClient(context.Background(), "blog-serve", option.WithServiceAccountFile("service-account.json"))
-	if err != nil {
-		panic(err)
-	}
+	if *project == "" {
+		fs = NewMemoryFileSystem("", "")
+	} else {
+		client, err := datastore.NewClient(context.Background(), *project, option.WithServiceAccountFile(*credentials))
+		if err != nil {
+			panic(err)
+		}
 
-	fs = NewFileSystem(client, "", "")
+		fs = NewFileSystem(client, "", "")
+	}
 	defer func() {
 		fs.RemoveAll("/tmp")
 	}()
@@ -0,0 +1,131 @@
+package dfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestCreateMode(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/dir/default.txt", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create("/dir/created.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want os.FileMode
+	}{
+		{"/dir", os.ModeDir | 0755},
+		{"/dir/default.txt", 0600},
+		{"/dir/created.txt", 0644},
+	}
+	for _, tt := range tests {
+		fi, err := fs.Stat(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != tt.want {
+			t.Errorf("%s: mode = %v, want %v", tt.name, fi.Mode(), tt.want)
+		}
+	}
+
+	fs = NewMemoryFileSystem("", "", WithUmask(0077))
+	if err := fs.Mkdir("/private", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := fs.Stat("/private"); fi.Mode() != os.ModeDir|0700 {
+		t.Errorf("mode = %v, want %v", fi.Mode(), os.ModeDir|0700)
+	}
+}
+
+func TestChmodChtimes(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	if err := afero.WriteFile(fs, "/file.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	atime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chmod("/file.txt", 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chtimes("/file.txt", atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session cache and a new session both see the changes
+	for _, fs := range []*FileSystem{fs, NewDriverFileSystem(ctx, driver, "", "")} {
+		fi, err := fs.Stat("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileData := fi.Sys().(*FileData)
+		if fi.Mode() != 0400 || !fi.ModTime().Equal(mtime) || !fileData.AccessTime.Equal(atime) {
+			t.Errorf("mode = %v, mtime = %v, atime = %v", fi.Mode(), fi.ModTime(), fileData.AccessTime)
+		}
+		b, err := afero.ReadFile(fs, "/file.txt")
+		if err != nil || string(b) != "data" {
+			t.Errorf("data = %q, err = %v", b, err)
+		}
+	}
+
+	if err := fs.Chmod("/missing.txt", 0644); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	if _, ok := fs.Chtimes("/missing.txt", atime, mtime).(*os.PathError); !ok {
+		t.Error("expected PathError")
+	}
+}
+
+func TestChtimesUnsaved(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	f, err := fs.Create("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the times are saved with the data when the file is closed
+	mtime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := fs.Chtimes("/file.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := NewDriverFileSystem(ctx, driver, "", "").Stat("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestMkdirAllDeep(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	// more directories than entity groups in a transaction
+	path := strings.Repeat("/dir", maxEntityGroups*2)
+	if err := fs.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(path); err != nil || !fi.IsDir() {
+		t.Errorf("err = %v", err)
+	}
+}
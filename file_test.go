@@ -0,0 +1,234 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/spf13/afero"
+)
+
+func TestReaddirCursor(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	for i := 0; i < 10; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/dir/%d", i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := []string{}
+	for {
+		fi, err := f.Readdir(3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fi {
+			names = append(names, fi.Name())
+		}
+
+		// removing files already read doesn't skip any
+		if err := fs.Remove("/dir/" + fi[0].Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(names) != 10 {
+		t.Errorf("read %d files, want 10: %v", len(names), names)
+	}
+}
+
+func TestIterDir(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	for i := 0; i < 5; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/dir/%d", i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := 0
+	err := fs.IterDir("/dir", func(fi os.FileInfo) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 5 {
+		t.Errorf("count = %d, err = %v", count, err)
+	}
+
+	errStop := errors.New("stop")
+	count = 0
+	err = fs.IterDir("/dir", func(fi os.FileInfo) error {
+		count++
+		if count == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || count != 2 {
+		t.Errorf("count = %d, err = %v", count, err)
+	}
+
+	if err := fs.IterDir("/dir/0", func(os.FileInfo) error { return nil }); err == nil {
+		t.Error("expected error iterating a file")
+	}
+	err = fs.IterDir("/missing", func(os.FileInfo) error { return nil })
+	if pe, ok := err.(*os.PathError); !ok || pe.Op != "readdir" || !os.IsNotExist(err) {
+		t.Errorf("err = %#v, want not exist *os.PathError", err)
+	}
+}
+
+func TestReaderContract(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	if err := afero.WriteFile(fs, "/file", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := iotest.TestReader(f, content); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPositionalIO(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	// positional reads and writes don't move the offset
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if n, err := f.ReadAt(b, 0); n != 5 || err != nil || string(b) != "Jello" {
+		t.Errorf("readat = %d %q, err = %v", n, b, err)
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 6 {
+		t.Errorf("offset = %d, want 6", pos)
+	}
+
+	// a short read at the end returns io.EOF
+	if n, err := f.ReadAt(b, 8); n != 3 || err != io.EOF || string(b[:n]) != "rld" {
+		t.Errorf("short readat = %d %q, err = %v", n, b[:n], err)
+	}
+
+	// writes in the middle advance by the bytes written
+	if _, err := f.Write([]byte("W")); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 7 {
+		t.Errorf("offset = %d, want 7", pos)
+	}
+
+	// writes past the end keep the data and fill the gap with zeros
+	if _, err := f.WriteAt([]byte("!"), 13); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(15, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("?")); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 20)
+	n, _ := f.ReadAt(b, 0)
+	if want := "Jello World\x00\x00!\x00?"; string(b[:n]) != want {
+		t.Errorf("data = %q, want %q", b[:n], want)
+	}
+}
+
+func TestSeekInvalid(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Seek(2, io.SeekStart)
+	for _, tt := range []struct {
+		offset int64
+		whence int
+	}{
+		{-1, io.SeekStart},
+		{-3, io.SeekCurrent},
+		{-6, io.SeekEnd},
+		{0, 3},
+	} {
+		if _, err := f.Seek(tt.offset, tt.whence); !errors.Is(err, os.ErrInvalid) {
+			t.Errorf("seek(%d, %d) err = %v", tt.offset, tt.whence, err)
+		}
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 2 {
+		t.Errorf("offset = %d, want 2", pos)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Error("negative readat succeeded")
+	}
+}
+
+func TestConcurrentReadAt(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	content := make([]byte, 1<<16)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := afero.WriteFile(fs, "/file", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := make([]byte, 1024)
+			for off := int64(i * 1024); off < int64(len(content)); off += 8 * 1024 {
+				if _, err := f.ReadAt(b, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(b, content[off:off+1024]) {
+					t.Errorf("data at %d differs", off)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
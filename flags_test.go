@@ -0,0 +1,177 @@
+package dfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestReadOnlyHandle(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []func() (afero.File, error){
+		func() (afero.File, error) { return fs.Open("/file") },
+		func() (afero.File, error) { return fs.OpenFile("/file", os.O_RDONLY, 0) },
+	} {
+		f, err := f()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("x")); pathErr(err) != ErrBadDescriptor {
+			t.Errorf("write err = %v", err)
+		}
+		if _, err := f.WriteAt([]byte("x"), 1); pathErr(err) != ErrBadDescriptor {
+			t.Errorf("writeat err = %v", err)
+		}
+		if _, err := f.WriteString("x"); pathErr(err) != ErrBadDescriptor {
+			t.Errorf("writestring err = %v", err)
+		}
+		if err := f.Truncate(0); pathErr(err) != ErrBadDescriptor {
+			t.Errorf("truncate err = %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b, err := afero.ReadFile(fs, "/file"); err != nil || string(b) != "hello" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestWriteOnlyHandle(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	f, err := fs.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := f.Read(b); pathErr(err) != ErrBadDescriptor {
+		t.Errorf("read err = %v", err)
+	}
+	if _, err := f.ReadAt(b, 0); pathErr(err) != ErrBadDescriptor {
+		t.Errorf("readat err = %v", err)
+	}
+}
+
+func TestOpenExclusive(t *testing.T) {
+	driver := NewMemoryDriver()
+	ctx := context.Background()
+	fs1 := NewDriverFileSystem(ctx, driver, "", "")
+	fs2 := NewDriverFileSystem(ctx, driver, "", "")
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	f, err := fs1.OpenFile("/lock", flag, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is saved as it is created so other sessions see it
+	if _, err := fs2.OpenFile("/lock", flag, 0644); !os.IsExist(err) {
+		t.Errorf("other session err = %v", err)
+	}
+	if _, err := fs1.OpenFile("/lock", flag, 0644); !os.IsExist(err) {
+		t.Errorf("same session err = %v", err)
+	}
+	f.Close()
+
+	// including new files that are only in the session cache
+	if _, err := fs1.Create("/new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs1.OpenFile("/new", flag, 0644); !os.IsExist(err) {
+		t.Errorf("unsaved err = %v", err)
+	}
+}
+
+func TestOpenExclusiveExisting(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// directories are saved at a generation, like files
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	for _, name := range []string{"/", "/a", "/a/b"} {
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Generation(fi) != 1 {
+			t.Errorf("%s: generation = %d, want 1", name, Generation(fi))
+		}
+	}
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if _, err := fs.OpenFile("/a/b", flag, 0644); !os.IsExist(err) {
+		t.Errorf("err = %v, want exist", err)
+	}
+	if fi, err := NewDriverFileSystem(ctx, driver, "", "").Stat("/a/b"); err != nil || !fi.IsDir() {
+		t.Errorf("directory err = %v", err)
+	}
+}
+
+func TestOpenSync(t *testing.T) {
+	driver := NewMemoryDriver()
+	ctx := context.Background()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	f, err := fs.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_SYNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := afero.ReadFile(NewDriverFileSystem(ctx, driver, "", ""), "/file")
+	if err != nil || string(b) != "hello" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+
+	if err := f.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	b, err = afero.ReadFile(NewDriverFileSystem(ctx, driver, "", ""), "/file")
+	if err != nil || string(b) != "he" {
+		t.Errorf("truncated data = %q, err = %v", b, err)
+	}
+}
+
+func TestOpenAppend(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/file", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := afero.ReadFile(fs, "/file"); err != nil || string(b) != "hello world" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
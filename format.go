@@ -0,0 +1,82 @@
+package dfs
+
+import (
+	"strings"
+)
+
+// formatSeparator separates the encodings listed in the FileData Format
+// which are applied in order when saving and reversed when loading
+const formatSeparator = "+"
+
+// encode sets the data to be stored and the Format it is stored in by
+// compressing and then encrypting it if enabled
+func (fs *FileSystem) encode(fileData *FileData) error {
+	data := fileData.Data
+	formats := []string{}
+	fileData.DataKey = nil
+
+	if len(data) > 0 && fs.compress(fileData.name) {
+		compressed, err := fs.codec.Encode(data)
+		if err != nil {
+			return err
+		}
+		// only keep the compressed data if it's smaller
+		if len(compressed) < len(data) {
+			data = compressed
+			formats = append(formats, fs.codec.Name())
+		}
+	}
+
+	if len(data) > 0 && fs.keys != nil {
+		encrypted, format, err := fs.encrypt(fileData, data)
+		if err != nil {
+			return err
+		}
+		data = encrypted
+		formats = append(formats, format)
+	}
+
+	fileData.encoded = data
+	fileData.Format = strings.Join(formats, formatSeparator)
+	fileData.measure()
+	return nil
+}
+
+// decode sets the file data from the stored data by reversing each of
+// the encodings listed in the Format
+func (fs *FileSystem) decode(fileData *FileData) error {
+	data := fileData.encoded
+	if fileData.Format != "" {
+		formats := strings.Split(fileData.Format, formatSeparator)
+		for i := len(formats) - 1; i >= 0; i-- {
+			decoded, err := fs.decodeFormat(fileData, formats[i], data)
+			if err != nil {
+				return err
+			}
+			data = decoded
+		}
+
+		if int64(len(data)) != fileData.Size {
+			return ErrSizeMismatch
+		}
+	}
+
+	if data == nil {
+		data = make([]byte, 0)
+	}
+	fileData.Data = data
+	fileData.measure()
+	return nil
+}
+
+func (fs *FileSystem) decodeFormat(fileData *FileData, format string, data []byte) ([]byte, error) {
+	if keyID, ok := encryptionKeyID(format); ok {
+		return fs.decrypt(fileData, keyID, data)
+	}
+
+	codec, ok := lookupCodec(format)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return codec.Decode(data)
+}
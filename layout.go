@@ -0,0 +1,103 @@
+package dfs
+
+import (
+	"os"
+)
+
+// WithAncestorKeys stores each file with the key of its directory as the
+// ancestor of its own key, instead of the flat layout where every file is
+// a root entity. Directory listings are then ancestor queries which are
+// strongly consistent so newly created files are always listed. All the
+// files are in the entity group of the root directory which limits the
+// rate they can be written at on the datastore. Existing files must be
+// moved to the layout using MigrateKeys.
+func WithAncestorKeys() Option {
+	return func(fs *FileSystem) {
+		fs.ancestorKeys = true
+	}
+}
+
+// MigrateKeys moves every file in the filesystem namespace and kind that
+// is stored with a key in the other layout to the layout the filesystem
+// uses, calling progress with the number of files moved so far after each
+// batch. It returns the number of files moved and can be run again if it
+// is interrupted. Files shouldn't be changed while they are migrated.
+func (fs *FileSystem) MigrateKeys(progress func(migrated int)) (_ int, err error) {
+	fs, span := fs.startSpan("MigrateKeys", filePathSeparator)
+	defer span.end(&err)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// cached files don't depend on the layout but they are reloaded
+	// after so nothing written during the migration is missed
+	defer fs.cache.removeAll(filePathSeparator)
+
+	count := 0
+	start := ""
+	for {
+		q := &Query{
+			Kind:      fs.kind,
+			Namespace: fs.namespace,
+			Start:     start,
+			Limit:     renameBatchSize,
+			KeysOnly:  true,
+		}
+
+		keys := []*Key{}
+		found := false
+		it := fs.driver.Run(fs.ctx, q)
+		for {
+			k, err := it.Next(nil)
+			if err == ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return count, err
+			}
+			found = true
+			if !equalKeys(k, fs.makeKey(k.Name)) {
+				keys = append(keys, k)
+			}
+		}
+		if !found {
+			return count, nil
+		}
+
+		cursor, err := it.Cursor()
+		if err != nil {
+			return count, err
+		}
+		start = cursor
+
+		if len(keys) == 0 {
+			continue
+		}
+
+		newKeys := make([]*Key, len(keys))
+		for i, key := range keys {
+			newKeys[i] = fs.makeKey(key.Name)
+		}
+		for len(keys) > 0 {
+			n, err := fs.moveBatch(keys, newKeys)
+			if err != nil {
+				return count, &os.PathError{Op: "migrate", Path: keys[0].Name, Err: err}
+			}
+			keys, newKeys = keys[n:], newKeys[n:]
+
+			count += n
+			if progress != nil {
+				progress(count)
+			}
+		}
+	}
+}
+
+// equalKeys returns whether the keys and all their ancestors are the same
+func equalKeys(a, b *Key) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Kind == b.Kind && a.Name == b.Name && a.Namespace == b.Namespace &&
+		equalKeys(a.Parent, b.Parent)
+}
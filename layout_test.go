@@ -0,0 +1,178 @@
+package dfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// keyLayouts returns how many of the file entities are stored with flat
+// keys and how many with ancestor keys, the root is the same for both
+func keyLayouts(t *testing.T, d Driver) (int, int) {
+	flat, ancestor := 0, 0
+	it := d.Run(context.Background(), &Query{Kind: "file", KeysOnly: true})
+	for {
+		k, err := it.Next(nil)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case k.Name == "/":
+		case k.Parent == nil:
+			flat++
+		default:
+			ancestor++
+		}
+	}
+	return flat, ancestor
+}
+
+func TestAncestorKeys(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithAncestorKeys())
+
+	writeTree(t, fs, "/site", 6)
+	if err := afero.WriteFile(fs, "/site-drafts/post.md", []byte("draft"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if flat, _ := keyLayouts(t, driver); flat != 0 {
+		t.Errorf("%d flat keys", flat)
+	}
+
+	// the key of a file has its directories as ancestors
+	fs2 := NewDriverFileSystem(ctx, driver, "", "", WithAncestorKeys())
+	key := fs2.makeKey("/site/sub/1/1.txt")
+	for _, name := range []string{"/site/sub/1", "/site/sub", "/site", "/"} {
+		key = key.Parent
+		if key == nil || key.Name != name {
+			t.Fatalf("ancestor = %v, want %s", key, name)
+		}
+	}
+	if key.Parent != nil {
+		t.Errorf("root has parent %v", key.Parent)
+	}
+
+	// an ancestor query only matches the subtree
+	names := memoryKeys(t, driver, &Query{Kind: "file", Ancestor: fs2.makeKey("/site/sub")})
+	want := []string{"/site/sub", "/site/sub/1", "/site/sub/1/1.txt", "/site/sub/3", "/site/sub/3/3.txt", "/site/sub/5", "/site/sub/5/5.txt"}
+	if !equalNames(names, want) {
+		t.Errorf("ancestor query = %v, want %v", names, want)
+	}
+
+	files, err := afero.ReadDir(fs2, "/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Errorf("read %d files, want 4", len(files))
+	}
+
+	if err := fs2.Rename("/site", "/public"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, fs2, "/public", "/site", 6)
+	if err := fs2.RemoveAll("/public"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Stat("/site-drafts/post.md"); err != nil {
+		t.Error(err)
+	}
+	if _, ancestor := keyLayouts(t, driver); ancestor != 2 {
+		t.Errorf("%d ancestor keys left, want 2", ancestor)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	flat := NewDriverFileSystem(ctx, driver, "", "")
+
+	n := renameBatchSize * 2
+	writeTree(t, flat, "/site", n)
+	large := bytes.Repeat([]byte("0123456789"), maxChunkSize/5)
+	if err := afero.WriteFile(flat, "/site/large.bin", large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks := countChunks(t, driver, "file")
+	if chunks == 0 {
+		t.Fatal("large file isn't chunked")
+	}
+
+	// the files, the directories below the path and the path itself
+	total := n + n/2 + 3
+
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithAncestorKeys())
+	progress := 0
+	count, err := fs.MigrateKeys(func(migrated int) {
+		if migrated <= progress {
+			t.Errorf("progress %d after %d", migrated, progress)
+		}
+		progress = migrated
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != total || progress != total {
+		t.Errorf("migrated %d (progress %d), want %d", count, progress, total)
+	}
+	if f, a := keyLayouts(t, driver); f != 0 || a != total {
+		t.Errorf("%d flat and %d ancestor keys, want 0 and %d", f, a, total)
+	}
+	if c := countChunks(t, driver, "file"); c != chunks {
+		t.Errorf("%d chunks, want %d", c, chunks)
+	}
+
+	checkTree(t, fs, "/site", "/site", n)
+	b, err := afero.ReadFile(fs, "/site/large.bin")
+	if err != nil || !bytes.Equal(b, large) {
+		t.Errorf("large file err = %v", err)
+	}
+
+	// running it again doesn't move anything
+	if count, err := fs.MigrateKeys(nil); count != 0 || err != nil {
+		t.Errorf("migrated %d again, err = %v", count, err)
+	}
+
+	// and the files can be moved back
+	if count, err := flat.MigrateKeys(nil); count != total || err != nil {
+		t.Errorf("migrated %d back, err = %v", count, err)
+	}
+	if f, a := keyLayouts(t, driver); f != total || a != 0 {
+		t.Errorf("%d flat and %d ancestor keys, want %d and 0", f, a, total)
+	}
+	if _, err := flat.Stat("/site/large.bin"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat("/site/large.bin"); !os.IsNotExist(err) {
+		t.Errorf("ancestor key err = %v", err)
+	}
+}
+
+func TestMigrateKeysLarge(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	flat := NewDriverFileSystem(ctx, driver, "", "")
+	data := writeLarge(t, flat, "/site", 4)
+
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithAncestorKeys())
+	progress := []int{}
+	count, err := fs.MigrateKeys(func(migrated int) {
+		progress = append(progress, migrated)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directory and the files, the root key is the same in both layouts
+	if count != 5 || len(progress) < 2 {
+		t.Errorf("migrated %d, progress %v", count, progress)
+	}
+	checkLarge(t, fs, "/site", 4, data)
+}
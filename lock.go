@@ -0,0 +1,498 @@
+package dfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"path/filepath"
+)
+
+type (
+	// LockFlags select the type of advisory lock, similar to flock
+	LockFlags int
+
+	// Lock is an advisory lock on a path held by this session. It is a
+	// lease which expires unless it is renewed before its TTL is up.
+	Lock struct {
+		mu      sync.Mutex
+		fs      *FileSystem
+		path    string
+		id      string
+		flags   LockFlags
+		token   int64
+		expires time.Time
+	}
+
+	// lockData is the lock entity for a path, holding the locks on the
+	// path and the intents of locks on paths below it so that a lock of
+	// the whole subtree can be checked in a single transaction
+	lockData struct {
+		Token   int64
+		Holders []lockHolder
+		Intents []lockHolder
+	}
+
+	// lockHolder is a lock or intent held by a session
+	lockHolder struct {
+		ID      string    `json:"id"`
+		Shared  bool      `json:"shared,omitempty"`
+		Subtree bool      `json:"subtree,omitempty"`
+		Token   int64     `json:"token,omitempty"`
+		Expires time.Time `json:"expires"`
+	}
+)
+
+const (
+	// LockShared takes a shared lock instead of an exclusive one
+	LockShared LockFlags = 1 << iota
+
+	// LockSubtree locks everything below the path as well as the path
+	LockSubtree
+
+	// LockNonBlocking returns ErrLocked instead of waiting for the lock
+	LockNonBlocking
+)
+
+const (
+	// DefaultLockTTL is how long a lock is held for unless it is renewed
+	DefaultLockTTL = 30 * time.Second
+
+	// lockRetryInterval is how often a blocked lock is attempted again
+	lockRetryInterval = 250 * time.Millisecond
+)
+
+var (
+	ErrLocked    = errors.New("Locked")
+	ErrLockLost  = errors.New("Lock lost")
+	ErrNotLocked = errors.New("Not locked")
+)
+
+// implements Entity
+var _ Entity = (*lockData)(nil)
+
+// WithLockTTL sets how long locks are held for unless they are renewed
+func WithLockTTL(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.lockTTL = ttl
+	}
+}
+
+// Lock takes an exclusive lock on the path and everything below it,
+// waiting until it is available
+func (fs *FileSystem) Lock(path string) (*Lock, error) {
+	return fs.LockPath(path, LockSubtree)
+}
+
+// RLock takes a shared lock on the path and everything below it, waiting
+// until it is available
+func (fs *FileSystem) RLock(path string) (*Lock, error) {
+	return fs.LockPath(path, LockShared|LockSubtree)
+}
+
+// LockPath takes an advisory lock on the path. Locks are only exclusive of
+// other locks, they don't prevent files being changed. Unless the flags
+// include LockNonBlocking it waits until the lock is available or the
+// context of the filesystem is done.
+func (fs *FileSystem) LockPath(path string, flags LockFlags) (_ *Lock, err error) {
+	fs, span := fs.startSpan("LockPath", path)
+	defer span.end(&err)
+
+	path = normalizePath(path)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, &os.PathError{Op: "lock", Path: path, Err: err}
+	}
+	l := &Lock{
+		fs:    fs,
+		path:  path,
+		id:    hex.EncodeToString(id),
+		flags: flags,
+	}
+
+	for {
+		err := l.acquire()
+		if err == nil {
+			return l, nil
+		}
+		if err != ErrLocked || flags&LockNonBlocking != 0 {
+			return nil, &os.PathError{Op: "lock", Path: path, Err: err}
+		}
+
+		select {
+		case <-fs.ctx.Done():
+			return nil, &os.PathError{Op: "lock", Path: path, Err: fs.ctx.Err()}
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// Lock takes an exclusive advisory lock on the file, like flock with
+// LOCK_EX, waiting until it is available
+func (f *File) Lock() error {
+	return f.Flock(0)
+}
+
+// RLock takes a shared advisory lock on the file, like flock with
+// LOCK_SH, waiting until it is available
+func (f *File) RLock() error {
+	return f.Flock(LockShared)
+}
+
+// TryLock takes an exclusive advisory lock on the file, like flock with
+// LOCK_EX|LOCK_NB, returning ErrLocked if it isn't available
+func (f *File) TryLock() error {
+	return f.Flock(LockNonBlocking)
+}
+
+// Flock takes an advisory lock on the file, replacing any lock already
+// held by the file handle. The lock is released when the file is closed.
+func (f *File) Flock(flags LockFlags) error {
+	if err := f.Unlock(); err != nil && err != ErrNotLocked {
+		return err
+	}
+	lock, err := f.fs.LockPath(f.Name(), flags)
+	if err != nil {
+		return err
+	}
+
+	// the handle isn't locked while waiting for the lock
+	f.mu.Lock()
+	prev := f.lock
+	f.lock = lock
+	f.mu.Unlock()
+
+	if prev != nil {
+		return prev.Unlock()
+	}
+	return nil
+}
+
+// Unlock releases the advisory lock held by the file handle, like flock
+// with LOCK_UN, returning ErrNotLocked if there isn't one
+func (f *File) Unlock() error {
+	f.mu.Lock()
+	lock := f.lock
+	f.lock = nil
+	f.mu.Unlock()
+
+	if lock == nil {
+		return ErrNotLocked
+	}
+	return lock.Unlock()
+}
+
+// Path is the path that is locked
+func (l *Lock) Path() string {
+	return l.path
+}
+
+// Token is the fencing token of the lock, which increases every time the
+// path is locked. WriteFileLocked checks it so that a holder whose lease
+// expired and was reclaimed can't overwrite the changes of the new holder.
+func (l *Lock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.token
+}
+
+// Expires is when the lock lease expires unless it is renewed
+func (l *Lock) Expires() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.expires
+}
+
+// Renew extends the lock lease by the TTL, returning ErrLockLost if
+// it has already expired and been reclaimed
+func (l *Lock) Renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires := time.Now().Add(l.fs.lockTTL)
+	err := l.update(func(holders []lockHolder) ([]lockHolder, error) {
+		for i := range holders {
+			if holders[i].ID == l.id {
+				holders[i].Expires = expires
+				return holders, nil
+			}
+		}
+		return nil, ErrLockLost
+	})
+	if err != nil {
+		return &os.PathError{Op: "renew", Path: l.path, Err: err}
+	}
+	l.expires = expires
+	return nil
+}
+
+// Unlock releases the lock, it is not an error if it has already expired
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.update(func(holders []lockHolder) ([]lockHolder, error) {
+		for i := range holders {
+			if holders[i].ID == l.id {
+				return append(holders[:i], holders[i+1:]...), nil
+			}
+		}
+		return holders, nil
+	})
+	if err != nil && err != ErrLockLost {
+		return &os.PathError{Op: "unlock", Path: l.path, Err: err}
+	}
+	return nil
+}
+
+// acquire attempts to take the lock, returning ErrLocked if it conflicts
+// with any other lock on the path, a lock of an ancestor's subtree or, if
+// locking the subtree, any lock below it
+func (l *Lock) acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	shared := l.flags&LockShared != 0
+	subtree := l.flags&LockSubtree != 0
+	expires := time.Now().Add(l.fs.lockTTL)
+
+	var token int64
+	err := l.fs.driver.RunInTransaction(l.fs.ctx, func(tx Transaction) error {
+		keys := l.fs.lockKeys(l.path)
+		locks := make([]*lockData, len(keys))
+		for i, key := range keys {
+			locks[i] = &lockData{}
+			if err := tx.Get(key, locks[i]); err != nil && err != ErrNoSuchEntity {
+				return err
+			}
+			locks[i].expire()
+		}
+
+		self := locks[len(locks)-1]
+		for _, h := range self.Holders {
+			if !(shared && h.Shared) {
+				return ErrLocked
+			}
+		}
+		if subtree {
+			for _, h := range self.Intents {
+				if !(shared && h.Shared) {
+					return ErrLocked
+				}
+			}
+		}
+		for _, ancestor := range locks[:len(locks)-1] {
+			for _, h := range ancestor.Holders {
+				if h.Subtree && !(shared && h.Shared) {
+					return ErrLocked
+				}
+			}
+		}
+
+		self.Token++
+		token = self.Token
+		self.Holders = append(self.Holders, lockHolder{ID: l.id, Shared: shared, Subtree: subtree, Token: token, Expires: expires})
+		for _, ancestor := range locks[:len(locks)-1] {
+			ancestor.Intents = append(ancestor.Intents, lockHolder{ID: l.id, Shared: shared, Expires: expires})
+		}
+
+		for i, key := range keys {
+			if err := tx.Put(key, locks[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.token = token
+	l.expires = expires
+	return nil
+}
+
+// update changes the holder of the lock on the path and the intents on its
+// ancestors in a transaction, returning ErrLockLost if the lock expired
+func (l *Lock) update(change func(holders []lockHolder) ([]lockHolder, error)) error {
+	return l.fs.driver.RunInTransaction(l.fs.ctx, func(tx Transaction) error {
+		keys := l.fs.lockKeys(l.path)
+		for i, key := range keys {
+			var lock lockData
+			if err := tx.Get(key, &lock); err != nil && err != ErrNoSuchEntity {
+				return err
+			}
+			lock.expire()
+
+			var err error
+			if i == len(keys)-1 {
+				lock.Holders, err = change(lock.Holders)
+			} else {
+				lock.Intents, err = change(lock.Intents)
+			}
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(key, &lock); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteFileLocked writes data to the named file only if the lock is still
+// held, checking its fencing token in the same transaction as the write. The
+// lock must be on the file or a subtree above it. If the lease expired and
+// was reclaimed by another holder an *os.PathError with ErrLockLost is
+// returned, and the file isn't changed.
+func (fs *FileSystem) WriteFileLocked(name string, data []byte, perm os.FileMode, lock *Lock) (err error) {
+	fs, span := fs.startSpan("WriteFileLocked", name)
+	defer span.end(&err)
+
+	name = normalizePath(name)
+
+	lock.mu.Lock()
+	path, subtree, id, token := lock.path, lock.flags&LockSubtree != 0, lock.id, lock.token
+	lock.mu.Unlock()
+	if path != name && !(subtree && strings.HasPrefix(name, subtreePrefix(path))) {
+		return &os.PathError{Op: "write", Path: name, Err: ErrNotLocked}
+	}
+
+	if err := fs.makeParent("write", name); err != nil {
+		return err
+	}
+
+	fileData := CreateFile(name)
+	fileData.dirty.Store(false)
+	fileData.Mode = int64(fs.applyUmask(perm))
+	fileData.Data = append(fileData.Data, data...)
+	fileData.Size = int64(len(data))
+	fileData.ModTime = time.Now()
+
+	err = fs.saveFileDataWith(fileData, anyGeneration, func(tx Transaction) error {
+		var current lockData
+		if err := tx.Get(fs.lockKey(path), &current); err != nil && err != ErrNoSuchEntity {
+			return err
+		}
+		current.expire()
+		for _, h := range current.Holders {
+			if h.ID == id && h.Token == token {
+				return nil
+			}
+		}
+		return ErrLockLost
+	})
+	if err != nil {
+		return pathError("write", name, err)
+	}
+
+	fs.cache.add(name, fileData)
+	return nil
+}
+
+// lockKeys returns the keys of the lock entities for each ancestor of
+// the path, from the root, followed by the path itself
+func (fs *FileSystem) lockKeys(path string) []*Key {
+	paths := []string{path}
+	for path != filePathSeparator {
+		path = filepath.Dir(path)
+		paths = append([]string{path}, paths...)
+	}
+
+	keys := make([]*Key, len(paths))
+	for i, path := range paths {
+		keys[i] = fs.lockKey(path)
+	}
+	return keys
+}
+
+// lockKey returns the key of the lock entity for the path. Every lock is
+// in the entity group of the root lock so that a path of any depth can be
+// locked in a single transaction.
+func (fs *FileSystem) lockKey(path string) *Key {
+	key := &Key{
+		Kind:      fs.kind + "_lock",
+		Name:      filePathSeparator,
+		Namespace: fs.namespace,
+	}
+	if path == filePathSeparator {
+		return key
+	}
+	return &Key{
+		Kind:      fs.kind + "_lock",
+		Name:      path,
+		Parent:    key,
+		Namespace: fs.namespace,
+	}
+}
+
+// expire removes the holders and intents whose lease has expired so that
+// the locks of crashed sessions can be reclaimed
+func (l *lockData) expire() {
+	now := time.Now()
+	l.Holders = unexpired(l.Holders, now)
+	l.Intents = unexpired(l.Intents, now)
+}
+
+func unexpired(holders []lockHolder, now time.Time) []lockHolder {
+	live := []lockHolder{}
+	for _, h := range holders {
+		if h.Expires.After(now) {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+// Load loads the datastore properties into the lock
+func (l *lockData) Load(props []Property) error {
+	l.Token = 0
+	l.Holders = nil
+	l.Intents = nil
+
+	for _, p := range props {
+		switch p.Name {
+		case "token":
+			l.Token, _ = p.Value.(int64)
+		case "holders":
+			if b, ok := p.Value.([]byte); ok {
+				if err := json.Unmarshal(b, &l.Holders); err != nil {
+					return err
+				}
+			}
+		case "intents":
+			if b, ok := p.Value.([]byte); ok {
+				if err := json.Unmarshal(b, &l.Intents); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Save returns the datastore properties for the lock
+func (l *lockData) Save() ([]Property, error) {
+	holders, err := json.Marshal(l.Holders)
+	if err != nil {
+		return nil, err
+	}
+	intents, err := json.Marshal(l.Intents)
+	if err != nil {
+		return nil, err
+	}
+	return []Property{
+		{Name: "token", Value: l.Token, NoIndex: true},
+		{Name: "holders", Value: holders, NoIndex: true},
+		{Name: "intents", Value: intents, NoIndex: true},
+	}, nil
+}
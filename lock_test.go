@@ -0,0 +1,239 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestLockConflicts(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs1 := NewDriverFileSystem(ctx, driver, "", "")
+	fs2 := NewDriverFileSystem(ctx, driver, "", "")
+
+	site, err := fs1.Lock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		flags LockFlags
+		err   error
+	}{
+		{"/site", LockShared, ErrLocked},
+		{"/site/public/index.html", 0, ErrLocked},
+		{"/site/public/index.html", LockShared, ErrLocked},
+		{"/", LockSubtree, ErrLocked},
+		{"/", 0, nil},
+		{"/other", LockSubtree, nil},
+	}
+	for _, tt := range tests {
+		l, err := fs2.LockPath(tt.path, tt.flags|LockNonBlocking)
+		if (tt.err == nil && err != nil) || (tt.err != nil && pathErr(err) != tt.err) {
+			t.Errorf("%s %d: err = %v, want %v", tt.path, tt.flags, err, tt.err)
+		}
+		if l != nil {
+			l.Unlock()
+		}
+	}
+
+	if err := site.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared locks are compatible with each other
+	r1, err := fs1.RLock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := fs2.LockPath("/site/public", LockShared|LockNonBlocking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.LockPath("/site/public", LockNonBlocking); pathErr(err) != ErrLocked {
+		t.Errorf("err = %v, want %v", err, ErrLocked)
+	}
+	r1.Unlock()
+	r2.Unlock()
+
+	// the fencing token increases every time the path is locked
+	l, err := fs2.Lock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Token() <= site.Token() {
+		t.Errorf("token = %d, previous %d", l.Token(), site.Token())
+	}
+	l.Unlock()
+}
+
+func TestLockLease(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	crashed := NewDriverFileSystem(ctx, driver, "", "", WithLockTTL(50*time.Millisecond))
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	l, err := crashed.Lock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := l.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := fs.LockPath("/site/index.html", LockNonBlocking); pathErr(err) != ErrLocked {
+		t.Errorf("renewed lock err = %v, want %v", err, ErrLocked)
+	}
+
+	// the lease expires so the lock can be reclaimed
+	reclaimed, err := fs.Lock("/site/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Renew(); pathErr(err) != ErrLockLost {
+		t.Errorf("err = %v, want %v", err, ErrLockLost)
+	}
+	reclaimed.Unlock()
+
+	// waiting for a lock stops when the context is done
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	held, _ := fs.Lock("/site")
+	defer held.Unlock()
+	if _, err := NewDriverFileSystem(ctx, driver, "", "").Lock("/site"); pathErr(err) != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	if err := afero.WriteFile(fs, "/file.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, _ := fs.Open("/file.txt")
+	f2, _ := NewDriverFileSystem(ctx, driver, "", "").Open("/file.txt")
+	file1, file2 := f1.(*File), f2.(*File)
+
+	if err := file1.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file2.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file1.TryLock(); pathErr(err) != ErrLocked {
+		t.Errorf("err = %v, want %v", err, ErrLocked)
+	}
+	if err := file2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file2.Unlock(); err != ErrNotLocked {
+		t.Errorf("err = %v, want %v", err, ErrNotLocked)
+	}
+	if err := file1.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the file releases the lock
+	f1.Close()
+	if err := file2.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	f2.Close()
+}
+
+func TestFileLockCloseFailure(t *testing.T) {
+	driver := newFaultDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+	if err := afero.WriteFile(fs, "/file.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.(*File).Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is closed but the caller is told the lock wasn't released
+	failed := errors.New("failed")
+	driver.inject("transaction", fault{err: failed})
+	err = f.Close()
+	if pe, ok := err.(*os.PathError); !ok || pe.Op != "unlock" || pe.Err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second close err = %v", err)
+	}
+}
+
+func TestWriteFileLocked(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	stale := NewDriverFileSystem(ctx, driver, "", "", WithLockTTL(50*time.Millisecond))
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	l, err := stale.Lock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.WriteFileLocked("/site/index.html", []byte("v1"), 0644, l); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.WriteFileLocked("/other.html", []byte("v1"), 0644, l); pathErr(err) != ErrNotLocked {
+		t.Errorf("outside lock err = %v, want %v", err, ErrNotLocked)
+	}
+
+	// once the lease is reclaimed the stale holder can't write
+	time.Sleep(60 * time.Millisecond)
+	reclaimed, err := fs.Lock("/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reclaimed.Unlock()
+	if reclaimed.Token() <= l.Token() {
+		t.Errorf("token = %d, want more than %d", reclaimed.Token(), l.Token())
+	}
+	if err := fs.WriteFileLocked("/site/index.html", []byte("v2"), 0644, reclaimed); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.WriteFileLocked("/site/index.html", []byte("v3"), 0644, l); pathErr(err) != ErrLockLost {
+		t.Errorf("stale err = %v, want %v", err, ErrLockLost)
+	}
+
+	b, err := afero.ReadFile(NewDriverFileSystem(ctx, driver, "", ""), "/site/index.html")
+	if err != nil || string(b) != "v2" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestLockDeepPath(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	// more ancestors than entity groups in a transaction
+	path := strings.Repeat("/dir", maxEntityGroups*2)
+	l, err := fs.Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.LockPath("/dir", LockSubtree|LockNonBlocking); pathErr(err) != ErrLocked {
+		t.Errorf("ancestor err = %v, want %v", err, ErrLocked)
+	}
+	if err := l.Renew(); err != nil {
+		t.Error(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,23 +1,143 @@
 package dfs
 
 import (
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"io/ioutil"
+
+	"golang.org/x/net/context"
 )
 
-var logger *log.Logger
+// legacyHandler implements slog.Handler by writing the records as text to
+// the package logger set by SetLogging, for filesystems without a handler
+type legacyHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   *log.Logger
+)
 
 func init() {
 	logger = log.New(ioutil.Discard, "dfs: ", log.Lshortfile)
 }
 
-// SetLogging to change log output
+// SetLogging to change log output of filesystems that weren't created
+// with a handler using WithLogHandler
 func SetLogging(val *log.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
 	logger = val
 }
 
+// Verbose logs the output of filesystems that weren't created with a
+// handler using WithLogHandler to stdout
 func Verbose() {
-	logger = log.New(os.Stdout, "dfs: ", log.Lshortfile)
+	SetLogging(log.New(os.Stdout, "dfs: ", log.Lshortfile))
+}
+
+func currentLogger() *log.Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+
+	return logger
+}
+
+// WithLogHandler logs the filesystem and file operations to the handler,
+// with the op, path, namespace, kind, duration and error as attributes.
+// Successful operations are logged at debug level and failures at error
+// level, except for expected errors such as a file not existing.
+func WithLogHandler(h slog.Handler) Option {
+	return func(fs *FileSystem) {
+		fs.log = slog.New(h)
+	}
+}
+
+// logOp logs the completion of an operation on the path
+func (fs *FileSystem) logOp(op, path string, start time.Time, err error, attrs ...slog.Attr) {
+	level := slog.LevelDebug
+	if isFailure(err) && !os.IsNotExist(err) && !os.IsExist(err) {
+		level = slog.LevelError
+	}
+	if !fs.log.Enabled(fs.ctx, level) {
+		return
+	}
+
+	attrs = append(attrs,
+		slog.String("op", op),
+		slog.String("path", path),
+		slog.Duration("duration", time.Since(start)))
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	fs.log.LogAttrs(fs.ctx, level, op, attrs...)
+}
+
+func (h *legacyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return currentLogger().Writer() != ioutil.Discard
+}
+
+func (h *legacyHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level > slog.LevelInfo {
+		b.WriteString(r.Level.String())
+		b.WriteByte(' ')
+	}
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		writeAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.group, a)
+		return true
+	})
+
+	// the caller of the slog.Logger method
+	return currentLogger().Output(4, b.String())
+}
+
+func (h *legacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := &legacyHandler{group: h.group}
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return h2
+}
+
+func (h *legacyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &legacyHandler{attrs: h.attrs, group: h.group + name + "."}
+}
+
+// writeAttr writes the attribute as key=value, flattening groups
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, prefix, ga)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%v", prefix, a.Key, a.Value)
 }
@@ -0,0 +1,131 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// loggedFileSystem returns a filesystem that logs JSON records to the buffer
+func loggedFileSystem(kind string, buf *bytes.Buffer) *FileSystem {
+	h := slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return NewMemoryFileSystem("blog", kind, WithLogHandler(h))
+}
+
+// logRecords decodes the JSON records in the buffer
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		r := map[string]interface{}{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// findRecord returns the last record of the op
+func findRecord(records []map[string]interface{}, op string) map[string]interface{} {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i]["op"] == op {
+			return records[i]
+		}
+	}
+	return nil
+}
+
+func TestLogHandler(t *testing.T) {
+	var drafts, public bytes.Buffer
+	fs1 := loggedFileSystem("drafts", &drafts)
+	fs2 := loggedFileSystem("public", &public)
+
+	if err := afero.WriteFile(fs1, "/hello.md", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Stat("/missing"); err == nil {
+		t.Fatal("missing file found")
+	}
+
+	records := logRecords(t, &drafts)
+	write := findRecord(records, "Write")
+	if write == nil {
+		t.Fatal("write not logged")
+	}
+	if write["path"] != "/hello.md" || write["namespace"] != "blog" || write["kind"] != "drafts" {
+		t.Errorf("write = %v", write)
+	}
+	if write["bytes"] != float64(5) || write["level"] != "DEBUG" {
+		t.Errorf("write = %v", write)
+	}
+	if _, ok := write["duration"]; !ok {
+		t.Error("no duration")
+	}
+	if findRecord(records, "Stat") != nil {
+		t.Error("other filesystem logged")
+	}
+
+	stat := findRecord(logRecords(t, &public), "Stat")
+	if stat == nil {
+		t.Fatal("stat not logged")
+	}
+	if stat["kind"] != "public" || stat["error"] == nil || stat["level"] != "DEBUG" {
+		t.Errorf("stat = %v", stat)
+	}
+}
+
+func TestLogHandlerErrorLevel(t *testing.T) {
+	var buf bytes.Buffer
+	fs := loggedFileSystem("", &buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.WithContext(ctx).Stat("/posts"); err == nil {
+		t.Fatal("cancelled stat succeeded")
+	}
+
+	stat := findRecord(logRecords(t, &buf), "Stat")
+	if stat == nil || stat["level"] != "ERROR" {
+		t.Errorf("stat = %v", stat)
+	}
+}
+
+func TestLogEOF(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	fs := NewMemoryFileSystem("", "", WithLogHandler(h))
+
+	// reading to the end of a file isn't an error
+	if err := afero.WriteFile(fs, "/hello.md", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afero.ReadFile(fs, "/hello.md"); err != nil {
+		t.Fatal(err)
+	}
+	if records := logRecords(t, &buf); len(records) != 0 {
+		t.Errorf("records = %v", records)
+	}
+}
+
+func TestLogFallback(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetLogging(currentLogger())
+	SetLogging(log.New(&buf, "dfs: ", 0))
+
+	fs := NewMemoryFileSystem("blog", "")
+	if _, err := fs.Create("/hello.md"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "dfs: Create") || !strings.Contains(out, "path=/hello.md") || !strings.Contains(out, "namespace=blog") {
+		t.Errorf("log = %q", out)
+	}
+}
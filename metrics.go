@@ -0,0 +1,418 @@
+package dfs
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+type (
+	// Collector is a Prometheus collector of the metrics of filesystems,
+	// labelled by namespace and kind, so it can be shared by several
+	// filesystems in the same process
+	Collector struct {
+		mu     sync.Mutex
+		caches map[*fileCache][2]string
+
+		operations *prometheus.HistogramVec
+		errors     *prometheus.CounterVec
+		calls      *prometheus.HistogramVec
+		entities   *prometheus.CounterVec
+		bytes      *prometheus.HistogramVec
+
+		cacheEntries *prometheus.Desc
+		cacheBytes   *prometheus.Desc
+		cacheDirty   *prometheus.Desc
+	}
+
+	// metricsDriver implements Driver by measuring the calls to another
+	metricsDriver struct {
+		Driver
+		c         *Collector
+		namespace string
+		kind      string
+	}
+
+	// metricsTransaction implements Transaction by measuring the calls to
+	// another, the time is that of the whole transaction. The entities are
+	// only counted once it is committed.
+	metricsTransaction struct {
+		tx      Transaction
+		d       *metricsDriver
+		pending []func()
+	}
+
+	// metricsIterator implements Iterator, counting the results read and
+	// timing the query until they have all been read
+	metricsIterator struct {
+		it    Iterator
+		d     *metricsDriver
+		start time.Time
+		done  bool
+	}
+
+	// measuredEntity records the size of an entity as it is loaded or saved
+	measuredEntity struct {
+		Entity
+		size int
+	}
+)
+
+// NewCollector creates a collector of filesystem metrics registered with
+// the registry. Filesystems report to it when created using WithMetrics.
+func NewCollector(reg prometheus.Registerer) (*Collector, error) {
+	labels := []string{"namespace", "kind"}
+	c := &Collector{
+		caches: make(map[*fileCache][2]string),
+		operations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dfs_operation_duration_seconds",
+			Help: "Duration of filesystem and file operations.",
+		}, append(labels, "operation")),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_operation_errors_total",
+			Help: "Filesystem and file operations that failed, by type of error.",
+		}, append(labels, "operation", "type")),
+		calls: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dfs_datastore_call_duration_seconds",
+			Help: "Duration of datastore calls.",
+		}, append(labels, "call")),
+		entities: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_datastore_entities_total",
+			Help: "Entities read, written or deleted by datastore calls, by entity kind.",
+		}, append(labels, "call")),
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dfs_datastore_entity_bytes",
+			Help:    "Size of the entities read or written by datastore calls, by entity kind.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, append(labels, "call")),
+		cacheEntries: prometheus.NewDesc("dfs_cache_entries",
+			"Files in the session caches.", labels, nil),
+		cacheBytes: prometheus.NewDesc("dfs_cache_bytes",
+			"Size of the file data in the session caches.", labels, nil),
+		cacheDirty: prometheus.NewDesc("dfs_cache_dirty_entries",
+			"Files in the session caches with unsaved changes.", labels, nil),
+	}
+	if err := reg.Register(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithMetrics reports the metrics of the filesystem to the collector
+func WithMetrics(c *Collector) Option {
+	return func(fs *FileSystem) {
+		fs.metrics = c
+	}
+}
+
+// Forget stops reporting the session cache of the filesystem, which the
+// collector otherwise holds on to, once it is no longer used
+func (c *Collector) Forget(fs *FileSystem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.caches, fs.cache)
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.operations.Describe(ch)
+	c.errors.Describe(ch)
+	c.calls.Describe(ch)
+	c.entities.Describe(ch)
+	c.bytes.Describe(ch)
+	ch <- c.cacheEntries
+	ch <- c.cacheBytes
+	ch <- c.cacheDirty
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.operations.Collect(ch)
+	c.errors.Collect(ch)
+	c.calls.Collect(ch)
+	c.entities.Collect(ch)
+	c.bytes.Collect(ch)
+
+	c.mu.Lock()
+	entries := make(map[[2]string]float64)
+	bytes := make(map[[2]string]float64)
+	dirty := make(map[[2]string]float64)
+	for cache, labels := range c.caches {
+		stats := cache.Stats()
+		entries[labels] += float64(stats.Entries)
+		bytes[labels] += float64(stats.Bytes)
+		dirty[labels] += float64(cache.dirty())
+	}
+	c.mu.Unlock()
+
+	for labels, v := range entries {
+		ch <- prometheus.MustNewConstMetric(c.cacheEntries, prometheus.GaugeValue, v, labels[0], labels[1])
+		ch <- prometheus.MustNewConstMetric(c.cacheBytes, prometheus.GaugeValue, bytes[labels], labels[0], labels[1])
+		ch <- prometheus.MustNewConstMetric(c.cacheDirty, prometheus.GaugeValue, dirty[labels], labels[0], labels[1])
+	}
+}
+
+// add starts reporting the metrics of the filesystem
+func (c *Collector) add(fs *FileSystem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.caches[fs.cache] = [2]string{fs.namespace, fs.kind}
+}
+
+// observe records a filesystem operation and the type of any error
+func (c *Collector) observe(fs *FileSystem, op string, start time.Time, err error) {
+	c.operations.WithLabelValues(fs.namespace, fs.kind, op).Observe(time.Since(start).Seconds())
+	if isFailure(err) {
+		c.errors.WithLabelValues(fs.namespace, fs.kind, op, errorType(err)).Inc()
+	}
+}
+
+// errorType classifies an error for the errors metric
+func errorType(err error) string {
+	switch {
+	case os.IsNotExist(err):
+		return "not_exist"
+	case os.IsExist(err):
+		return "exist"
+	case IsConflict(err):
+		return "conflict"
+	}
+
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	switch err {
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "deadline"
+	case ErrConcurrentTransaction:
+		return "contention"
+	case ErrLocked:
+		return "locked"
+	}
+	if _, ok := err.(*TransientError); ok {
+		return "transient"
+	}
+	return "other"
+}
+
+func (d *metricsDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	start := time.Now()
+	e := &measuredEntity{Entity: dst}
+	err := d.Driver.Get(ctx, key, e)
+	d.observe("get", start, err, []*Key{key}, e)
+	return err
+}
+
+func (d *metricsDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	start := time.Now()
+	e := &measuredEntity{Entity: src}
+	err := d.Driver.Put(ctx, key, e)
+	d.observe("put", start, err, []*Key{key}, e)
+	return err
+}
+
+func (d *metricsDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	start := time.Now()
+	es := measureEntities(src)
+	err := d.Driver.PutMulti(ctx, keys, es)
+	d.observe("put", start, err, keys, measured(es)...)
+	return err
+}
+
+func (d *metricsDriver) Delete(ctx context.Context, key *Key) error {
+	start := time.Now()
+	err := d.Driver.Delete(ctx, key)
+	d.observeDelete(start, err, []*Key{key})
+	return err
+}
+
+func (d *metricsDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	start := time.Now()
+	err := d.Driver.DeleteMulti(ctx, keys)
+	d.observeDelete(start, err, keys)
+	return err
+}
+
+func (d *metricsDriver) Run(ctx context.Context, q *Query) Iterator {
+	return &metricsIterator{it: d.Driver.Run(ctx, q), d: d, start: time.Now()}
+}
+
+func (d *metricsDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	start := time.Now()
+	var committed *metricsTransaction
+	err := d.Driver.RunInTransaction(ctx, func(tx Transaction) error {
+		// only the last attempt is committed
+		committed = &metricsTransaction{tx: tx, d: d}
+		return f(committed)
+	})
+	d.c.calls.WithLabelValues(d.namespace, d.kind, "transaction").Observe(time.Since(start).Seconds())
+	if err == nil && committed != nil {
+		for _, count := range committed.pending {
+			count()
+		}
+	}
+	return err
+}
+
+// observe records a datastore call and the entities it read or wrote
+func (d *metricsDriver) observe(call string, start time.Time, err error, keys []*Key, entities ...*measuredEntity) {
+	d.c.calls.WithLabelValues(d.namespace, d.kind, call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return
+	}
+	d.count(call, keys, entities...)
+}
+
+func (d *metricsDriver) observeDelete(start time.Time, err error, keys []*Key) {
+	d.c.calls.WithLabelValues(d.namespace, d.kind, "delete").Observe(time.Since(start).Seconds())
+	if err == nil {
+		d.countKeys("delete", keys)
+	}
+}
+
+// count records the entities read or written by a call, by the kind of
+// their keys
+func (d *metricsDriver) count(call string, keys []*Key, entities ...*measuredEntity) {
+	d.countKeys(call, keys)
+	for i, e := range entities {
+		d.c.bytes.WithLabelValues(d.namespace, keys[i].Kind, call).Observe(float64(e.size))
+	}
+}
+
+// countKeys records the entities of a call by the kind of their keys
+func (d *metricsDriver) countKeys(call string, keys []*Key) {
+	for _, key := range keys {
+		d.c.entities.WithLabelValues(d.namespace, key.Kind, call).Inc()
+	}
+}
+
+// later counts the entities of a call once the transaction is committed
+func (t *metricsTransaction) later(count func()) {
+	t.pending = append(t.pending, count)
+}
+
+func (t *metricsTransaction) Get(key *Key, dst Entity) error {
+	e := &measuredEntity{Entity: dst}
+	err := t.tx.Get(key, e)
+	if err == nil {
+		t.later(func() { t.d.count("get", []*Key{key}, e) })
+	}
+	return err
+}
+
+func (t *metricsTransaction) GetMulti(keys []*Key, dst []Entity) error {
+	es := measureEntities(dst)
+	err := t.tx.GetMulti(keys, es)
+	if err == nil {
+		t.later(func() { t.d.count("get", keys, measured(es)...) })
+	}
+	return err
+}
+
+func (t *metricsTransaction) Put(key *Key, src Entity) error {
+	e := &measuredEntity{Entity: src}
+	err := t.tx.Put(key, e)
+	if err == nil {
+		t.later(func() { t.d.count("put", []*Key{key}, e) })
+	}
+	return err
+}
+
+func (t *metricsTransaction) PutMulti(keys []*Key, src []Entity) error {
+	es := measureEntities(src)
+	err := t.tx.PutMulti(keys, es)
+	if err == nil {
+		t.later(func() { t.d.count("put", keys, measured(es)...) })
+	}
+	return err
+}
+
+func (t *metricsTransaction) Delete(key *Key) error {
+	err := t.tx.Delete(key)
+	if err == nil {
+		t.later(func() { t.d.countKeys("delete", []*Key{key}) })
+	}
+	return err
+}
+
+func (t *metricsTransaction) DeleteMulti(keys []*Key) error {
+	err := t.tx.DeleteMulti(keys)
+	if err == nil {
+		t.later(func() { t.d.countKeys("delete", keys) })
+	}
+	return err
+}
+
+func (i *metricsIterator) Next(dst Entity) (*Key, error) {
+	if dst == nil {
+		k, err := i.it.Next(nil)
+		if err == nil {
+			i.d.countKeys("query", []*Key{k})
+		} else {
+			i.end()
+		}
+		return k, err
+	}
+
+	e := &measuredEntity{Entity: dst}
+	k, err := i.it.Next(e)
+	if err == nil {
+		i.d.count("query", []*Key{k}, e)
+	} else {
+		i.end()
+	}
+	return k, err
+}
+
+func (i *metricsIterator) Cursor() (string, error) {
+	i.end()
+	return i.it.Cursor()
+}
+
+// end records the duration of the query the first time it is called
+func (i *metricsIterator) end() {
+	if i.done {
+		return
+	}
+	i.done = true
+	i.d.c.calls.WithLabelValues(i.d.namespace, i.d.kind, "query").Observe(time.Since(i.start).Seconds())
+}
+
+// Load implements Entity, recording the size of the properties
+func (e *measuredEntity) Load(props []Property) error {
+	e.size = propertiesSize(props)
+	return e.Entity.Load(props)
+}
+
+// Save implements Entity, recording the size of the properties
+func (e *measuredEntity) Save() ([]Property, error) {
+	props, err := e.Entity.Save()
+	e.size = propertiesSize(props)
+	return props, err
+}
+
+func measureEntities(entities []Entity) []Entity {
+	es := make([]Entity, len(entities))
+	for i, e := range entities {
+		es[i] = &measuredEntity{Entity: e}
+	}
+	return es
+}
+
+func measured(entities []Entity) []*measuredEntity {
+	es := make([]*measuredEntity, len(entities))
+	for i, e := range entities {
+		es[i] = e.(*measuredEntity)
+	}
+	return es
+}
@@ -0,0 +1,175 @@
+package dfs
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// measuredFileSystem returns a filesystem that reports to a new collector
+func measuredFileSystem(t *testing.T) (*FileSystem, *Collector) {
+	c, err := NewCollector(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewDriverFileSystem(context.Background(), NewMemoryDriver(), "blog", "drafts", WithMetrics(c))
+	return fs, c
+}
+
+func TestMetricsOperations(t *testing.T) {
+	fs, c := measuredFileSystem(t)
+
+	f, err := fs.Create("/hello.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.CollectAndCount(c.operations, "dfs_operation_duration_seconds"); n == 0 {
+		t.Fatal("no operations recorded")
+	}
+	for _, op := range []string{"Create", "Write", "Close"} {
+		h := c.operations.WithLabelValues("blog", "drafts", op).(prometheus.Histogram)
+		if n := histogramCount(t, h); n != 1 {
+			t.Errorf("%s count = %d", op, n)
+		}
+	}
+
+	if n := testutil.ToFloat64(c.entities.WithLabelValues("blog", "drafts", "put")); n == 0 {
+		t.Error("no entities put")
+	}
+	h := c.bytes.WithLabelValues("blog", "drafts", "put").(prometheus.Histogram)
+	if sum := histogramSum(t, h); sum < 1000 {
+		t.Errorf("put bytes = %v", sum)
+	}
+}
+
+func TestMetricsErrors(t *testing.T) {
+	fs, c := measuredFileSystem(t)
+
+	if _, err := fs.Stat("/missing"); err == nil {
+		t.Fatal("missing file found")
+	}
+	if n := testutil.ToFloat64(c.errors.WithLabelValues("blog", "drafts", "Stat", "not_exist")); n != 1 {
+		t.Errorf("not_exist errors = %v", n)
+	}
+
+	fs.Mkdir("/posts", 0755)
+	if err := fs.Mkdir("/posts", 0755); err == nil {
+		t.Fatal("existing directory created")
+	}
+	if n := testutil.ToFloat64(c.errors.WithLabelValues("blog", "drafts", "Mkdir", "exist")); n != 1 {
+		t.Errorf("exist errors = %v", n)
+	}
+
+	// reading to the end of a file isn't an error
+	if err := afero.WriteFile(fs, "/posts/hello.md", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afero.ReadFile(fs, "/posts/hello.md"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(c.errors, "dfs_operation_errors_total"); n != 2 {
+		t.Errorf("%d error series, want 2", n)
+	}
+}
+
+func TestMetricsEntityKinds(t *testing.T) {
+	fs, c := measuredFileSystem(t)
+
+	// the chunks of a large file are counted as their own kind
+	if err := afero.WriteFile(fs, "/large.bin", make([]byte, maxChunkSize+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(c.entities.WithLabelValues("blog", "drafts_chunk", "put")); n != 2 {
+		t.Errorf("chunks put = %v, want 2", n)
+	}
+
+	// the entities of a transaction that isn't committed aren't counted
+	gets := testutil.ToFloat64(c.entities.WithLabelValues("blog", "drafts", "get"))
+	if _, err := fs.WriteFileIf("/large.bin", []byte("hello"), 0644, 5); !IsConflict(err) {
+		t.Fatalf("err = %v, want conflict", err)
+	}
+	if n := testutil.ToFloat64(c.entities.WithLabelValues("blog", "drafts", "get")); n != gets {
+		t.Errorf("gets = %v, want %v", n, gets)
+	}
+}
+
+func TestMetricsCache(t *testing.T) {
+	fs, c := measuredFileSystem(t)
+
+	f, err := fs.Create("/hello.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	gauge := func(name string) float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == name {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+
+	if n := gauge("dfs_cache_dirty_entries"); n != 1 {
+		t.Errorf("dirty = %v", n)
+	}
+	if n := gauge("dfs_cache_entries"); n < 1 {
+		t.Errorf("entries = %v", n)
+	}
+
+	f.Close()
+	if n := gauge("dfs_cache_dirty_entries"); n != 0 {
+		t.Errorf("dirty after close = %v", n)
+	}
+
+	c.Forget(fs)
+	if n := gauge("dfs_cache_entries"); n != -1 {
+		t.Errorf("entries after forget = %v", n)
+	}
+}
+
+func TestMetricsRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := NewCollector(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCollector(reg); err == nil {
+		t.Error("collector registered twice")
+	}
+}
+
+func histogramCount(t *testing.T, h prometheus.Histogram) uint64 {
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func histogramSum(t *testing.T, h prometheus.Histogram) float64 {
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
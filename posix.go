@@ -0,0 +1,70 @@
+package dfs
+
+import (
+	"os"
+
+	"path/filepath"
+)
+
+// WithStrictPOSIX makes the filesystem follow the os package where it is
+// otherwise more lenient: Create and OpenFile fail if the parent directory
+// doesn't exist rather than creating it and so does Mkdir. Errors that
+// are always returned, such as removing a directory that isn't empty or
+// creating a directory below a file, don't depend on the mode.
+func WithStrictPOSIX() Option {
+	return func(fs *FileSystem) {
+		fs.strict = true
+	}
+}
+
+// checkParent returns an os.PathError if the parent directory of the named
+// file doesn't exist or isn't a directory
+func (fs *FileSystem) checkParent(op, name string) error {
+	dir := filepath.Dir(name)
+	if dir == name {
+		return nil
+	}
+
+	parent, err := fs.open(dir)
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	if !parent.Directory {
+		return &os.PathError{Op: op, Path: name, Err: ErrNotDirectory}
+	}
+	return nil
+}
+
+// makeParent checks the parent directory of the named file for a new file,
+// creating it if it doesn't exist unless the filesystem is strict
+func (fs *FileSystem) makeParent(op, name string) error {
+	err := fs.checkParent(op, name)
+	if err == nil || fs.strict || !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Dir(name), DefaultDirMode); err != nil {
+		return pathError(op, name, err)
+	}
+	return nil
+}
+
+// isEmptyDir returns whether the named directory has no files below it,
+// including new files that haven't been saved yet
+func (fs *FileSystem) isEmptyDir(name string) (bool, error) {
+	if fs.cache.hasDescendants(name) {
+		return false, nil
+	}
+	files, _, err := fs.readDir(name, "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(files) == 0, nil
+}
+
+// pathError wraps the error in an os.PathError unless it already is one
+func pathError(op, name string, err error) error {
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
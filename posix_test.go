@@ -0,0 +1,135 @@
+// +build !appengine
+
+package dfs
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// posixSteps are run in order on each filesystem, the error of each is
+// compared with the error from the os package
+var posixSteps = []struct {
+	name string
+	op   func(fs afero.Fs) error
+}{
+	{"mkdir dir", func(fs afero.Fs) error { return fs.Mkdir("/dir", 0755) }},
+	{"create file", func(fs afero.Fs) error { return afero.WriteFile(fs, "/file", []byte("file"), 0644) }},
+	{"create in dir", func(fs afero.Fs) error { return afero.WriteFile(fs, "/dir/file", []byte("file"), 0644) }},
+	{"mkdir existing dir", func(fs afero.Fs) error { return fs.Mkdir("/dir", 0755) }},
+	{"mkdir existing file", func(fs afero.Fs) error { return fs.Mkdir("/file", 0755) }},
+	{"mkdir root", func(fs afero.Fs) error { return fs.Mkdir("/", 0755) }},
+	{"mkdir missing parent", func(fs afero.Fs) error { return fs.Mkdir("/missing/dir", 0755) }},
+	{"mkdir in file", func(fs afero.Fs) error { return fs.Mkdir("/file/dir", 0755) }},
+	{"mkdirall existing", func(fs afero.Fs) error { return fs.MkdirAll("/dir", 0755) }},
+	{"mkdirall file", func(fs afero.Fs) error { return fs.MkdirAll("/file", 0755) }},
+	{"mkdirall in file", func(fs afero.Fs) error { return fs.MkdirAll("/file/a/b", 0755) }},
+	{"create dir", func(fs afero.Fs) error { return createClose(fs, "/dir") }},
+	{"create missing parent", func(fs afero.Fs) error { return createClose(fs, "/missing/file") }},
+	{"create in file", func(fs afero.Fs) error { return createClose(fs, "/file/file") }},
+	{"open dir for writing", func(fs afero.Fs) error { return openClose(fs, "/dir", os.O_RDWR) }},
+	{"open dir for reading", func(fs afero.Fs) error { return openClose(fs, "/dir", os.O_RDONLY) }},
+	{"open missing", func(fs afero.Fs) error { return openClose(fs, "/missing", os.O_RDONLY) }},
+	{"stat missing", func(fs afero.Fs) error { _, err := fs.Stat("/missing"); return err }},
+	{"remove missing", func(fs afero.Fs) error { return fs.Remove("/missing") }},
+	{"remove non-empty dir", func(fs afero.Fs) error { return fs.Remove("/dir") }},
+	{"remove file", func(fs afero.Fs) error { return fs.Remove("/dir/file") }},
+	{"remove empty dir", func(fs afero.Fs) error { return fs.Remove("/dir") }},
+}
+
+func createClose(fs afero.Fs, name string) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func openClose(fs afero.Fs, name string, flag int) error {
+	f, err := fs.OpenFile(name, flag, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// posixErr returns the error a portable caller would check for
+func posixErr(err error) error {
+	if e := pathErr(err); e != nil {
+		err = e
+	}
+	switch {
+	case os.IsNotExist(err):
+		return os.ErrNotExist
+	case err == syscall.EEXIST:
+		return os.ErrExist
+	}
+	return err
+}
+
+func TestStrictPOSIX(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	osFs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	fs := NewMemoryFileSystem("", "", WithStrictPOSIX())
+
+	for _, step := range posixSteps {
+		want := step.op(osFs)
+		got := step.op(fs)
+		if posixErr(got) != posixErr(want) {
+			t.Errorf("%s: err = %v, want %v", step.name, got, want)
+		}
+		if _, ok := got.(*os.PathError); got != nil && !ok {
+			t.Errorf("%s: err = %#v, want *os.PathError", step.name, got)
+		}
+	}
+}
+
+func TestLenientPOSIX(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	// missing parents are created
+	if err := createClose(fs, "/a/b/file"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat("/a/b"); err != nil || !fi.IsDir() {
+		t.Errorf("parent err = %v", err)
+	}
+	if err := fs.Mkdir("/c/d", 0755); err != nil {
+		t.Errorf("mkdir err = %v", err)
+	}
+
+	// but not below a file
+	if err := createClose(fs, "/a/b/file/file"); posixErr(err) != ErrNotDirectory {
+		t.Errorf("create err = %v", err)
+	}
+	if err := fs.Mkdir("/a/b/file/dir", 0755); posixErr(err) != ErrNotDirectory {
+		t.Errorf("mkdir err = %v", err)
+	}
+}
+
+func TestRemoveUnsavedChild(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := fs.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new file is only in the session cache until it is closed
+	f, err := fs.Create("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fs.Remove("/dir"); posixErr(err) != ErrDirectoryNotEmpty {
+		t.Errorf("err = %v, want %v", err, ErrDirectoryNotEmpty)
+	}
+}
@@ -0,0 +1,163 @@
+package dfs
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func TestRemoveAllExact(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	names := []string{
+		"/blog/post.md",
+		"/blog/2017/post.md",
+		"/blog/café/post.md",
+		"/blog-drafts/post.md",
+		"/blog-drafts/2017/post.md",
+		"/blogroll/link.md",
+		"/blog.md",
+	}
+	for _, name := range names {
+		if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.RemoveAll("/blog"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names[:3] {
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: err = %v, want not exist", name, err)
+		}
+	}
+	for _, name := range names[3:] {
+		if _, err := fs.Stat(name); err != nil {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	if _, err := fs.Stat("/blog"); !os.IsNotExist(err) {
+		t.Errorf("directory err = %v", err)
+	}
+}
+
+func TestRemoveAllOpenHandle(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+	if err := afero.WriteFile(fs, "/blog/2017/post.md", []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// files below the directory with unsaved changes aren't saved again
+	// when their handles are closed
+	saved, err := fs.OpenFile("/blog/2017/post.md", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := fs.Create("/blog/draft.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []afero.File{saved, created} {
+		if _, err := f.Write([]byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.RemoveAll("/blog"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []afero.File{saved, created} {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := NewDriverFileSystem(context.Background(), driver, "", "")
+	for _, name := range []string{"/blog", "/blog/2017/post.md", "/blog/draft.md"} {
+		if _, err := reloaded.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s: err = %v, want not exist", name, err)
+		}
+	}
+}
+
+func TestRemoveAllBatches(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	n := removeBatchSize*2 + 1
+	writeTree(t, fs, "/site", n)
+
+	// the tree is read into the session cache
+	checkTree(t, fs, "/site", "/site", n)
+
+	progress := []int{}
+	err := fs.RemoveAllFunc("/site", func(removed int) {
+		progress = append(progress, removed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(progress) < 3 {
+		t.Errorf("progress = %v, want at least 3 batches", progress)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("progress = %v, not increasing", progress)
+			break
+		}
+	}
+	// the files, the directories below the path and the path itself
+	if total := n + n/2 + 2; progress[len(progress)-1] != total {
+		t.Errorf("removed = %d, want %d", progress[len(progress)-1], total)
+	}
+
+	if keys := memoryKeys(t, driver, &Query{Kind: "file"}); len(keys) != 1 {
+		t.Errorf("%d entities left, want only the root", len(keys))
+	}
+	for _, fs := range []*FileSystem{fs, NewDriverFileSystem(ctx, driver, "", "")} {
+		if _, err := fs.Stat("/site/0.txt"); !os.IsNotExist(err) {
+			t.Errorf("file err = %v", err)
+		}
+		if _, err := fs.Stat("/site"); !os.IsNotExist(err) {
+			t.Errorf("directory err = %v", err)
+		}
+	}
+}
+
+func TestRemoveAllBatchLimit(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	// more files than can be deleted in a single call
+	for i := 0; i <= maxBatchKeys; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/site/%d.txt", i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.RemoveAll("/site"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := memoryKeys(t, driver, &Query{Kind: "file"}); len(keys) != 1 {
+		t.Errorf("%d entities left, want only the root", len(keys))
+	}
+}
+
+func TestRemoveAllMissing(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+
+	if err := fs.RemoveAll("/missing"); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	if err := fs.RemoveAll("/missing/child"); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
@@ -0,0 +1,300 @@
+package dfs
+
+import (
+	"os"
+	"strings"
+
+	"path/filepath"
+)
+
+type (
+	// renameData records a directory rename in progress, keyed by the old
+	// name, so that it can be resumed if it is interrupted
+	renameData struct {
+		NewName string `datastore:"new_name,noindex"`
+	}
+)
+
+// renameBatchSize is the number of files moved in each transaction, each
+// file touches two entity groups (25 limit on cross-group transactions)
+const renameBatchSize = 10
+
+// implements Entity
+var _ Entity = (*renameData)(nil)
+
+// Load loads the datastore properties into the rename
+func (r *renameData) Load(props []Property) error {
+	for _, p := range props {
+		if p.Name == "new_name" {
+			r.NewName, _ = p.Value.(string)
+		}
+	}
+	return nil
+}
+
+// Save returns the datastore properties for the rename
+func (r *renameData) Save() ([]Property, error) {
+	return []Property{
+		{Name: "new_name", Value: r.NewName, NoIndex: true},
+	}, nil
+}
+
+// ResumeRenames completes any directory renames that were interrupted,
+// returning the number resumed
+func (fs *FileSystem) ResumeRenames() (_ int, err error) {
+	fs, span := fs.startSpan("ResumeRenames", filePathSeparator)
+	defer span.end(&err)
+
+	q := &Query{
+		Kind:      fs.kind + "_rename",
+		Namespace: fs.namespace,
+	}
+
+	count := 0
+	it := fs.driver.Run(fs.ctx, q)
+	for {
+		var rename renameData
+		k, err := it.Next(&rename)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := fs.resumeRename(k.Name, rename.NewName); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// resumeRename completes an interrupted directory rename, holding the lock
+// as Rename does so other changes can't be made at the same time
+func (fs *FileSystem) resumeRename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.moveDescendants(oldname, newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	fs.cache.rename(oldname, newname, 0, 0)
+	return nil
+}
+
+// checkRename returns the file to be renamed, or an error if it can't be
+// renamed following the os.Rename rules: the destination directory must
+// exist, a directory can only replace an empty directory and a file can't
+// replace a directory
+func (fs *FileSystem) checkRename(oldname, newname string) (*FileData, error) {
+	src, err := fs.open(oldname)
+	if err != nil {
+		return nil, openErr(err)
+	}
+	if src.Directory && strings.HasPrefix(newname, subtreePrefix(oldname)) {
+		return nil, os.ErrInvalid
+	}
+
+	parent, err := fs.open(filepath.Dir(newname))
+	if err != nil {
+		return nil, openErr(err)
+	}
+	if !parent.Directory {
+		return nil, ErrNotDirectory
+	}
+
+	dst, err := fs.open(newname)
+	if os.IsNotExist(err) {
+		return src, nil
+	}
+	if err != nil {
+		return nil, openErr(err)
+	}
+	switch {
+	case src.Directory && !dst.Directory:
+		return nil, ErrNotDirectory
+	case !src.Directory && dst.Directory:
+		return nil, ErrIsDirectory
+	case dst.Directory:
+		empty, err := fs.isEmptyDir(newname)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, ErrDirectoryNotEmpty
+		}
+	}
+	return src, nil
+}
+
+// openErr returns the error from opening a file without the os.PathError
+// it may be wrapped in, as it is wrapped in an os.LinkError instead
+func openErr(err error) error {
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// renameDir moves the directory then everything below it in batches. The
+// rename is recorded with the directory move so that it can be resumed.
+func (fs *FileSystem) renameDir(oldname, newname string) (int64, int64, error) {
+	var loaded, generation int64
+	var unused []string
+
+	err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		key := &Key{
+			Kind:      fs.kind + "_rename",
+			Name:      oldname,
+			Namespace: fs.namespace,
+		}
+		if err := tx.Put(key, &renameData{NewName: newname}); err != nil {
+			return err
+		}
+
+		var err error
+		loaded, generation, unused, err = fs.moveFileData(tx, oldname, newname)
+		return err
+	})
+	if err == ErrNoSuchEntity {
+		return 0, 0, ErrFileNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	fs.deleteBlobs(unused...)
+
+	if err := fs.moveDescendants(oldname, newname); err != nil {
+		return 0, 0, err
+	}
+	return loaded, generation, nil
+}
+
+// moveDescendants moves the files below the old directory to the new one
+// in batches and then removes the record of the rename
+func (fs *FileSystem) moveDescendants(oldname, newname string) error {
+	for _, filters := range subtreeFilters(oldname) {
+		for {
+			q := &Query{
+				Kind:      fs.kind,
+				Namespace: fs.namespace,
+				Filters:   filters,
+				Limit:     renameBatchSize,
+				KeysOnly:  true,
+			}
+			names, err := fs.queryNames(q)
+			if err != nil {
+				return err
+			}
+			if len(names) == 0 {
+				break
+			}
+
+			oldKeys := make([]*Key, len(names))
+			newKeys := make([]*Key, len(names))
+			for i, name := range names {
+				oldKeys[i] = fs.makeKey(name)
+				newKeys[i] = fs.makeKey(newname + strings.TrimPrefix(name, oldname))
+			}
+			for len(oldKeys) > 0 {
+				n, err := fs.moveBatch(oldKeys, newKeys)
+				if err != nil {
+					return err
+				}
+				oldKeys, newKeys = oldKeys[n:], newKeys[n:]
+			}
+		}
+	}
+
+	return fs.driver.Delete(fs.ctx, &Key{
+		Kind:      fs.kind + "_rename",
+		Name:      oldname,
+		Namespace: fs.namespace,
+	})
+}
+
+// moveBatch moves files from the old keys to the new keys in a transaction,
+// as many as fit within the datastore limit on the size of a transaction,
+// and returns the number moved. The first file always fits on its own.
+func (fs *FileSystem) moveBatch(oldKeys, newKeys []*Key) (int, error) {
+	var moved int
+	var unused []string
+	err := fs.driver.RunInTransaction(fs.ctx, func(tx Transaction) error {
+		moved, unused = 0, nil
+		size := 0
+		for i, key := range oldKeys {
+			var fileData FileData
+			err := tx.Get(key, &fileData)
+			if err == ErrNoSuchEntity {
+				// already moved, the query index was stale
+				moved++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			size += storedSize(&fileData)
+			if moved > 0 && size > maxTransactionSize {
+				return nil
+			}
+
+			_, _, blobs, err := fs.moveFileKey(tx, key, newKeys[i], newKeys[i].Name)
+			if err != nil {
+				return err
+			}
+			unused = append(unused, blobs...)
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	fs.deleteBlobs(unused...)
+	return moved, nil
+}
+
+// queryNames returns the names of the files matching the query
+func (fs *FileSystem) queryNames(q *Query) ([]string, error) {
+	names := []string{}
+	it := fs.driver.Run(fs.ctx, q)
+	for {
+		k, err := it.Next(nil)
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, k.Name)
+	}
+	return names, nil
+}
+
+// subtreePrefix is the prefix of the names of all files below the path
+func subtreePrefix(path string) string {
+	return strings.TrimSuffix(path, filePathSeparator) + filePathSeparator
+}
+
+// subtreeFilters returns the query filters that match every file below the
+// path: the files in the directory and those in directories below it
+func subtreeFilters(path string) [][]Filter {
+	prefix := subtreePrefix(path)
+
+	// the next character after the separator ends the range
+	end := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+
+	return [][]Filter{
+		{
+			{Property: "parent", Operator: "=", Value: path},
+		},
+		{
+			{Property: "parent", Operator: ">=", Value: prefix},
+			{Property: "parent", Operator: "<", Value: end},
+		},
+	}
+}
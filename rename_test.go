@@ -0,0 +1,258 @@
+package dfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+func writeTree(t *testing.T, fs afero.Fs, dir string, n int) {
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s/%d.txt", dir, i)
+		if i%2 == 1 {
+			name = fmt.Sprintf("%s/sub/%d/%d.txt", dir, i, i)
+		}
+		if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTree(t *testing.T, fs afero.Fs, dir, from string, n int) {
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s/%d.txt", dir, i)
+		data := fmt.Sprintf("%s/%d.txt", from, i)
+		if i%2 == 1 {
+			name = fmt.Sprintf("%s/sub/%d/%d.txt", dir, i, i)
+			data = fmt.Sprintf("%s/sub/%d/%d.txt", from, i, i)
+		}
+		b, err := afero.ReadFile(fs, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(b) != data {
+			t.Errorf("%s: data = %q, want %q", name, b, data)
+		}
+	}
+}
+
+// writeLarge writes n files in the directory that are each split into
+// chunks, together too large to be written in a single transaction
+func writeLarge(t *testing.T, fs afero.Fs, dir string, n int) []byte {
+	data := bytes.Repeat([]byte("0123456789"), maxChunkSize*3/10)
+	for i := 0; i < n; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("%s/%d.bin", dir, i), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func checkLarge(t *testing.T, fs afero.Fs, dir string, n int, data []byte) {
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s/%d.bin", dir, i)
+		b, err := afero.ReadFile(fs, name)
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	writeTree(t, fs, "/site", renameBatchSize*3)
+	if err := afero.WriteFile(fs, "/site2/other.txt", []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an open file is moved with the directory
+	f, err := fs.OpenFile("/site/0.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/site", "/public"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt([]byte("/"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fs := range []*FileSystem{fs, NewDriverFileSystem(ctx, driver, "", "")} {
+		if _, err := fs.Stat("/site"); !os.IsNotExist(err) {
+			t.Errorf("old directory err = %v", err)
+		}
+		if n := len(memoryKeys(t, driver, &Query{Kind: "file", Filters: subtreeFilters("/site")[1]})); n != 0 {
+			t.Errorf("%d files left in old subtree", n)
+		}
+		names, err := afero.ReadDir(fs, "/public/sub")
+		if err != nil || len(names) != renameBatchSize*3/2 {
+			t.Errorf("read %d names, err = %v", len(names), err)
+		}
+		checkTree(t, fs, "/public", "/site", renameBatchSize*3)
+
+		// a sibling with the same prefix isn't moved
+		if _, err := fs.Stat("/site2/other.txt"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRenameRules(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	for _, name := range []string{"/file.txt", "/other.txt", "/full/file.txt"} {
+		if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"/dir/sub", "/empty"} {
+		if err := fs.MkdirAll(name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		oldname, newname string
+		err              error
+	}{
+		{"/missing", "/new", ErrFileNotFound},
+		{"/missing", "/missing", ErrFileNotFound},
+		{"/file.txt", "/file.txt", nil},
+		{"/file.txt", "/missing/file.txt", ErrFileNotFound},
+		{"/file.txt", "/other.txt/file.txt", ErrNotDirectory},
+		{"/file.txt", "/empty", ErrIsDirectory},
+		{"/dir", "/file.txt", ErrNotDirectory},
+		{"/dir", "/full", ErrDirectoryNotEmpty},
+		{"/dir", "/dir/sub/dir", os.ErrInvalid},
+		{"/dir", "/empty", nil},
+		{"/file.txt", "/other.txt", nil},
+	}
+	for _, tt := range tests {
+		err := fs.Rename(tt.oldname, tt.newname)
+		if le, ok := err.(*os.LinkError); ok {
+			err = le.Err
+		}
+		if err != tt.err {
+			t.Errorf("%s -> %s: err = %v, want %v", tt.oldname, tt.newname, err, tt.err)
+		}
+	}
+
+	if fi, err := fs.Stat("/empty/sub"); err != nil || !fi.IsDir() {
+		t.Errorf("err = %v", err)
+	}
+	b, err := afero.ReadFile(fs, "/other.txt")
+	if err != nil || string(b) != "/file.txt" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestRenameUnsaved(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+
+	// a file that hasn't been closed yet is moved with its changes
+	f, err := fs.Create("/draft.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename("/draft.md", "/post.md"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewDriverFileSystem(context.Background(), driver, "", "")
+	if _, err := reloaded.Stat("/draft.md"); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	b, err := afero.ReadFile(reloaded, "/post.md")
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("data = %q, err = %v", b, err)
+	}
+}
+
+func TestRenameResume(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	writeTree(t, fs, "/site", renameBatchSize*2)
+
+	// interrupt the rename after the directory has been moved
+	err := driver.RunInTransaction(ctx, func(tx Transaction) error {
+		key := &Key{Kind: "file_rename", Name: "/site"}
+		if err := tx.Put(key, &renameData{NewName: "/public"}); err != nil {
+			return err
+		}
+		_, _, _, err := fs.moveFileData(tx, "/site", "/public")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs = NewDriverFileSystem(ctx, driver, "", "")
+	n, err := fs.ResumeRenames()
+	if err != nil || n != 1 {
+		t.Fatalf("resumed %d, err = %v", n, err)
+	}
+	checkTree(t, fs, "/public", "/site", renameBatchSize*2)
+	if n, _ := fs.ResumeRenames(); n != 0 {
+		t.Errorf("resumed %d again", n)
+	}
+}
+
+func TestRenameDirLarge(t *testing.T) {
+	ctx := context.Background()
+	driver := NewMemoryDriver()
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+
+	data := writeLarge(t, fs, "/site", 4)
+	if err := fs.Rename("/site", "/public"); err != nil {
+		t.Fatal(err)
+	}
+	checkLarge(t, NewDriverFileSystem(ctx, driver, "", ""), "/public", 4, data)
+}
+
+func TestRenameLoadError(t *testing.T) {
+	ctx := context.Background()
+	driver := newFaultDriver()
+	if err := afero.WriteFile(NewDriverFileSystem(ctx, driver, "", ""), "/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the error loading the file is returned rather than not found
+	fs := NewDriverFileSystem(ctx, driver, "", "")
+	failed := errors.New("failed")
+	driver.inject("get", fault{err: failed})
+	err := fs.Rename("/a.txt", "/b.txt")
+	if le, ok := err.(*os.LinkError); !ok || le.Err != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+
+	if err := fs.Rename("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/b.txt"); err != nil {
+		t.Error(err)
+	}
+}
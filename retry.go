@@ -0,0 +1,178 @@
+package dfs
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// RetryPolicy controls how datastore operations that fail with a
+	// transient error are retried, with an exponential backoff between
+	// attempts that is randomised by the jitter
+	RetryPolicy struct {
+		// MaxAttempts is the most times an operation is attempted,
+		// including the first
+		MaxAttempts int
+
+		// InitialBackoff is the delay before the first retry
+		InitialBackoff time.Duration
+
+		// MaxBackoff limits the delay between attempts
+		MaxBackoff time.Duration
+
+		// Multiplier is how much the delay grows after each attempt
+		Multiplier float64
+
+		// Jitter is the fraction of each delay that is random, from 0 for
+		// none to 1 for anything up to the full delay
+		Jitter float64
+
+		// Retryable returns whether an operation that failed with the
+		// error can be retried, IsRetryable is used if it isn't set
+		Retryable func(err error, idempotent bool) bool
+
+		// OnRetry is called before each retry with the name of the driver
+		// operation, the attempt that failed, the delay and its error
+		OnRetry func(op string, attempt int, delay time.Duration, err error)
+	}
+
+	// TransientError is returned by a Driver for an error that may not
+	// happen again if the operation is retried, such as the datastore
+	// being unavailable. Uncertain is set if the operation may have been
+	// applied anyway, like a commit that timed out, in which case it is
+	// only safe to retry operations that are idempotent.
+	TransientError struct {
+		Err       error
+		Uncertain bool
+	}
+
+	// retryDriver implements Driver by retrying the operations of another
+	retryDriver struct {
+		Driver
+		policy RetryPolicy
+		log    *slog.Logger
+	}
+)
+
+// DefaultRetryPolicy is a policy suitable for most uses, trying each
+// operation up to 5 times with at most 1.5 seconds between them in total
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// WithRetry retries datastore operations that fail with transient errors
+// using the policy. Gets, puts and deletes are idempotent so are retried
+// after any transient error but transactions are only retried if they
+// were definitely not committed. Queries are not retried.
+func WithRetry(policy RetryPolicy) Option {
+	return func(fs *FileSystem) {
+		fs.retry = &policy
+	}
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports that the error is temporary, as for net.Error
+func (e *TransientError) Temporary() bool {
+	return true
+}
+
+// IsRetryable returns whether an operation that failed with the error can
+// be retried: if there was contention with another transaction or it is a
+// TransientError and the operation either wasn't applied or is idempotent
+func IsRetryable(err error, idempotent bool) bool {
+	if err == ErrConcurrentTransaction {
+		return true
+	}
+	if te, ok := err.(*TransientError); ok {
+		return idempotent || !te.Uncertain
+	}
+	return false
+}
+
+func (d *retryDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	return d.do(ctx, "get", true, func() error {
+		return d.Driver.Get(ctx, key, dst)
+	})
+}
+
+func (d *retryDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	return d.do(ctx, "put", true, func() error {
+		return d.Driver.Put(ctx, key, src)
+	})
+}
+
+func (d *retryDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	return d.do(ctx, "putmulti", true, func() error {
+		return d.Driver.PutMulti(ctx, keys, src)
+	})
+}
+
+func (d *retryDriver) Delete(ctx context.Context, key *Key) error {
+	return d.do(ctx, "delete", true, func() error {
+		return d.Driver.Delete(ctx, key)
+	})
+}
+
+func (d *retryDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	return d.do(ctx, "deletemulti", true, func() error {
+		return d.Driver.DeleteMulti(ctx, keys)
+	})
+}
+
+func (d *retryDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return d.do(ctx, "transaction", false, func() error {
+		return d.Driver.RunInTransaction(ctx, f)
+	})
+}
+
+// do runs the operation until it succeeds, fails with an error that can't
+// be retried or has been attempted as many times as the policy allows
+func (d *retryDriver) do(ctx context.Context, op string, idempotent bool, f func() error) error {
+	retryable := d.policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= d.policy.MaxAttempts || !retryable(err, idempotent) {
+			return err
+		}
+
+		delay := d.policy.backoff(attempt)
+		if d.policy.OnRetry != nil {
+			d.policy.OnRetry(op, attempt, delay, err)
+		}
+		d.log.Warn("retry", "call", op, "attempt", attempt, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay after the attempt, growing exponentially up
+// to the maximum with the jitter fraction of it randomised
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || delay < float64(p.MaxBackoff)); i++ {
+		delay *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	delay -= delay * p.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
@@ -0,0 +1,226 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+type (
+	// faultDriver injects errors into the operations of another driver
+	faultDriver struct {
+		Driver
+		mu     sync.Mutex
+		faults map[string][]fault
+		calls  map[string]int
+	}
+
+	// fault is an error returned by an operation, after it is applied
+	// to the driver if applied is set
+	fault struct {
+		err     error
+		applied bool
+	}
+)
+
+func newFaultDriver() *faultDriver {
+	return &faultDriver{
+		Driver: NewMemoryDriver(),
+		faults: make(map[string][]fault),
+		calls:  make(map[string]int),
+	}
+}
+
+// inject queues faults for the next calls of the operation
+func (d *faultDriver) inject(op string, faults ...fault) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.faults[op] = append(d.faults[op], faults...)
+}
+
+func (d *faultDriver) count(op string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.calls[op]
+}
+
+func (d *faultDriver) call(op string, f func() error) error {
+	d.mu.Lock()
+	d.calls[op]++
+	var next *fault
+	if len(d.faults[op]) > 0 {
+		next = &d.faults[op][0]
+		d.faults[op] = d.faults[op][1:]
+	}
+	d.mu.Unlock()
+
+	if next == nil {
+		return f()
+	}
+	if next.applied {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return next.err
+}
+
+func (d *faultDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	return d.call("get", func() error { return d.Driver.Get(ctx, key, dst) })
+}
+
+func (d *faultDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	return d.call("put", func() error { return d.Driver.Put(ctx, key, src) })
+}
+
+func (d *faultDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	return d.call("putmulti", func() error { return d.Driver.PutMulti(ctx, keys, src) })
+}
+
+func (d *faultDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	return d.call("transaction", func() error { return d.Driver.RunInTransaction(ctx, f) })
+}
+
+var (
+	errUnavailable = &TransientError{Err: errors.New("unavailable"), Uncertain: true}
+	errExhausted   = &TransientError{Err: errors.New("resource exhausted")}
+)
+
+// testRetryPolicy retries quickly, recording the retries
+func testRetryPolicy(retries *[]string) RetryPolicy {
+	p := DefaultRetryPolicy
+	p.InitialBackoff = time.Millisecond
+	p.MaxBackoff = 4 * time.Millisecond
+	p.OnRetry = func(op string, attempt int, delay time.Duration, err error) {
+		*retries = append(*retries, op)
+	}
+	return p
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	driver := newFaultDriver()
+	retries := []string{}
+	fs := NewDriverFileSystem(context.Background(), driver, "", "", WithRetry(testRetryPolicy(&retries)))
+
+	driver.inject("get", fault{err: errUnavailable}, fault{err: errExhausted})
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	if n := driver.count("get"); n != 3 {
+		t.Errorf("get called %d times, want 3", n)
+	}
+	if !equalNames(retries, []string{"get", "get"}) {
+		t.Errorf("retries = %v", retries)
+	}
+}
+
+func TestRetryTransaction(t *testing.T) {
+	driver := newFaultDriver()
+	retries := []string{}
+	fs := NewDriverFileSystem(context.Background(), driver, "", "", WithRetry(testRetryPolicy(&retries)))
+
+	// the root directory is saved in a transaction the first time
+	if _, err := fs.Stat("/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := driver.count("transaction"); n != 1 {
+		t.Errorf("transaction called %d times, want 1", n)
+	}
+
+	// contention and errors before the commit are retried
+	driver.inject("transaction", fault{err: ErrConcurrentTransaction}, fault{err: errExhausted})
+	if err := afero.WriteFile(fs, "/post.md", []byte("post"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := driver.count("transaction"); n != 4 {
+		t.Errorf("transaction called %d times, want 4", n)
+	}
+
+	// but a commit that may have been applied isn't
+	driver.inject("transaction", fault{err: errUnavailable, applied: true})
+	err := afero.WriteFile(fs, "/post.md", []byte("changed"), 0644)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != errUnavailable {
+		t.Errorf("err = %v, want %v", err, errUnavailable)
+	}
+	if n := driver.count("transaction"); n != 5 {
+		t.Errorf("transaction called %d times, want 5", n)
+	}
+
+	fi, err := NewDriverFileSystem(context.Background(), driver, "", "").Stat("/post.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := Generation(fi); g != 2 {
+		t.Errorf("generation = %d, want 2 (saved once each time)", g)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	driver := newFaultDriver()
+	retries := []string{}
+	policy := testRetryPolicy(&retries)
+	policy.MaxAttempts = 3
+	fs := NewDriverFileSystem(context.Background(), driver, "", "", WithRetry(policy))
+
+	driver.inject("get", fault{err: errUnavailable}, fault{err: errUnavailable}, fault{err: errUnavailable})
+	if _, err := fs.Stat("/missing"); pathErr(err) != errUnavailable {
+		t.Errorf("err = %v, want %v", err, errUnavailable)
+	}
+	if n := driver.count("get"); n != 3 {
+		t.Errorf("get called %d times, want 3", n)
+	}
+
+	// errors that aren't transient aren't retried
+	failed := errors.New("failed")
+	driver.inject("get", fault{err: failed})
+	if _, err := fs.Stat("/other"); pathErr(err) != failed {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+	if n := driver.count("get"); n != 4 {
+		t.Errorf("get called %d times, want 4", n)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	driver := newFaultDriver()
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := DefaultRetryPolicy
+	policy.InitialBackoff = time.Hour
+	policy.OnRetry = func(string, int, time.Duration, error) {
+		cancel()
+	}
+	fs := NewDriverFileSystem(ctx, driver, "", "", WithRetry(policy))
+
+	driver.inject("get", fault{err: errUnavailable})
+	if _, err := fs.Stat("/missing"); pathErr(err) != context.Canceled {
+		t.Errorf("err = %v, want canceled", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if d := p.backoff(i + 1); d != w*time.Millisecond {
+			t.Errorf("attempt %d: backoff = %v, want %v", i+1, d, w*time.Millisecond)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("backoff = %v, want 100-200ms", d)
+		}
+	}
+}
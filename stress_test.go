@@ -0,0 +1,195 @@
+package dfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// stress runs the workers in parallel, each for the number of iterations,
+// and is most useful with go test -race
+func stress(t *testing.T, iterations int, workers ...func(i int) error) {
+	if testing.Short() && iterations > 10 {
+		iterations /= 10
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(workers))
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w func(i int) error) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if err := w(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStressFiles(t *testing.T) {
+	fs := NewMemoryFileSystem("", "", WithCacheLimit(8, 0))
+	const files = 16
+	for i := 0; i < files; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/dir/%d", i), []byte("initial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := func(i int) string { return fmt.Sprintf("/dir/%d", i%files) }
+
+	reader := func(i int) error {
+		_, err := afero.ReadFile(fs, name(i))
+		return err
+	}
+	writer := func(i int) error {
+		f, err := fs.OpenFile(name(i), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt([]byte("written"), int64(i%10)); err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte("more")); err != nil {
+			return err
+		}
+		if i%7 == 0 {
+			if err := f.Truncate(4); err != nil {
+				return err
+			}
+		}
+		return f.Close()
+	}
+	stat := func(i int) error {
+		fi, err := fs.Stat(name(i))
+		if err != nil {
+			return err
+		}
+		fi.Size()
+		fi.ModTime()
+		return nil
+	}
+	walker := func(i int) error {
+		return afero.Walk(fs, "/dir", func(path string, fi os.FileInfo, err error) error {
+			if err == nil {
+				fi.Size()
+			}
+			return err
+		})
+	}
+
+	stress(t, 200, reader, reader, writer, writer, stat, walker)
+}
+
+func TestStressHandle(t *testing.T) {
+	fs := NewMemoryFileSystem("", "")
+	if err := afero.WriteFile(fs, "/file", make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := afero.WriteFile(fs, fmt.Sprintf("/dir/%d", i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the handles are shared by all the workers
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dir, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	b := make([]byte, 64)
+	reader := func(i int) error {
+		b := make([]byte, 64)
+		if _, err := f.ReadAt(b, int64(i*64%4096)); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := f.Read(b); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	writer := func(i int) error {
+		if _, err := f.WriteAt(b, int64(i*64%4096)); err != nil {
+			return err
+		}
+		_, err := f.Write(b[:1])
+		return err
+	}
+	seeker := func(i int) error {
+		_, err := f.Seek(int64(i%4096), io.SeekStart)
+		if err == nil {
+			_, err = f.Stat()
+		}
+		return err
+	}
+	lister := func(i int) error {
+		if _, err := dir.Readdir(3); err != nil && err != io.EOF {
+			return err
+		}
+		if i%5 == 0 {
+			_, err := dir.Seek(0, io.SeekStart)
+			return err
+		}
+		return nil
+	}
+	reopen := func(i int) error {
+		g, err := fs.Open("/file")
+		if err != nil {
+			return err
+		}
+		if _, err := g.Stat(); err != nil {
+			return err
+		}
+		return g.Close()
+	}
+
+	stress(t, 500, reader, reader, writer, seeker, lister, lister, reopen)
+}
+
+func TestStressOpenMiss(t *testing.T) {
+	driver := NewMemoryDriver()
+	if err := afero.WriteFile(NewDriverFileSystem(context.Background(), driver, "", ""), "/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every worker misses the cache of the new session at the same time
+	// but they must all share the same file data
+	fs := NewDriverFileSystem(context.Background(), driver, "", "")
+	var mu sync.Mutex
+	seen := map[*FileData]bool{}
+	open := func(i int) error {
+		f, err := fs.Open("/file")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		mu.Lock()
+		seen[f.(*File).fileData] = true
+		mu.Unlock()
+		return nil
+	}
+
+	stress(t, 1, open, open, open, open, open, open, open, open)
+	if len(seen) != 1 {
+		t.Errorf("%d copies of the file data", len(seen))
+	}
+}
@@ -0,0 +1,268 @@
+package dfs
+
+import (
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+type (
+	// span is the trace span of a filesystem operation, which does nothing
+	// unless tracing is enabled, that also records its metrics and log
+	span struct {
+		trace.Span
+		fs    *FileSystem
+		op    string
+		path  string
+		start time.Time
+	}
+
+	// tracingDriver implements Driver by tracing the calls to another as
+	// child spans of the filesystem operation in the context
+	tracingDriver struct {
+		Driver
+		tracer trace.Tracer
+	}
+
+	// tracingTransaction implements Transaction by tracing the calls to
+	// another as child spans of the transaction
+	tracingTransaction struct {
+		tx     Transaction
+		ctx    context.Context
+		tracer trace.Tracer
+	}
+
+	// tracingIterator implements Iterator, ending the span of the query
+	// once its results have been read
+	tracingIterator struct {
+		it    Iterator
+		span  trace.Span
+		count int
+		ended bool
+	}
+)
+
+// tracerName is the instrumentation name of the tracer
+const tracerName = "github.com/captaincodeman/afero-datastore"
+
+// WithTracerProvider traces each filesystem and file operation as an
+// OpenTelemetry span with the datastore calls it makes as child spans
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(fs *FileSystem) {
+		fs.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// startSpan starts the span of an operation on the path, returning a view
+// of the filesystem with the span in its context so the datastore calls
+// made using it are traced as its children
+func (fs *FileSystem) startSpan(op, path string) (*FileSystem, span) {
+	s := span{
+		Span:  trace.SpanFromContext(context.Background()),
+		fs:    fs,
+		op:    op,
+		path:  path,
+		start: time.Now(),
+	}
+	if fs.tracer == nil {
+		return fs, s
+	}
+
+	ctx, ts := fs.tracer.Start(fs.ctx, "dfs."+op, trace.WithAttributes(
+		attribute.String("dfs.op", op),
+		attribute.String("dfs.path", path),
+	))
+	s.Span = ts
+	s.fs = fs.WithContext(ctx)
+	return s.fs, s
+}
+
+// traceCache records a lookup in the session cache on the current span
+func (fs *FileSystem) traceCache(name string, hit bool) {
+	if fs.tracer == nil {
+		return
+	}
+	event := "dfs.cache.miss"
+	if hit {
+		event = "dfs.cache.hit"
+	}
+	trace.SpanFromContext(fs.ctx).AddEvent(event, trace.WithAttributes(attribute.String("dfs.path", name)))
+}
+
+// end ends the span, recording the error if there is one
+func (s span) end(err *error) {
+	s.finish(*err)
+}
+
+// endBytes ends the span of a read or write, recording the bytes moved
+func (s span) endBytes(n *int, err *error) {
+	s.SetAttributes(attribute.Int("dfs.bytes", *n))
+	s.finish(*err, slog.Int("bytes", *n))
+}
+
+func (s span) finish(err error, attrs ...slog.Attr) {
+	if s.fs.metrics != nil {
+		s.fs.metrics.observe(s.fs, s.op, s.start, err)
+	}
+	s.fs.logOp(s.op, s.path, s.start, err, attrs...)
+	if isFailure(err) {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+func (d *tracingDriver) Get(ctx context.Context, key *Key, dst Entity) error {
+	_, s := d.start(ctx, "Get", keyAttributes(key)...)
+	err := d.Driver.Get(ctx, key, dst)
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) Put(ctx context.Context, key *Key, src Entity) error {
+	_, s := d.start(ctx, "Put", keyAttributes(key)...)
+	err := d.Driver.Put(ctx, key, src)
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) PutMulti(ctx context.Context, keys []*Key, src []Entity) error {
+	_, s := d.start(ctx, "PutMulti", attribute.Int("datastore.keys", len(keys)))
+	err := d.Driver.PutMulti(ctx, keys, src)
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) Delete(ctx context.Context, key *Key) error {
+	_, s := d.start(ctx, "Delete", keyAttributes(key)...)
+	err := d.Driver.Delete(ctx, key)
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) DeleteMulti(ctx context.Context, keys []*Key) error {
+	_, s := d.start(ctx, "DeleteMulti", attribute.Int("datastore.keys", len(keys)))
+	err := d.Driver.DeleteMulti(ctx, keys)
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) Run(ctx context.Context, q *Query) Iterator {
+	_, s := d.start(ctx, "Run",
+		attribute.String("datastore.kind", q.Kind),
+		attribute.Int("datastore.filters", len(q.Filters)),
+		attribute.Int("datastore.limit", q.Limit),
+		attribute.Bool("datastore.keys_only", q.KeysOnly))
+	return &tracingIterator{it: d.Driver.Run(ctx, q), span: s}
+}
+
+func (d *tracingDriver) RunInTransaction(ctx context.Context, f func(tx Transaction) error) error {
+	ctx, s := d.start(ctx, "RunInTransaction")
+	err := d.Driver.RunInTransaction(ctx, func(tx Transaction) error {
+		return f(&tracingTransaction{tx: tx, ctx: ctx, tracer: d.tracer})
+	})
+	endSpan(s, err)
+	return err
+}
+
+func (d *tracingDriver) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return d.tracer.Start(ctx, "datastore."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (t *tracingTransaction) Get(key *Key, dst Entity) error {
+	s := t.start("Get", keyAttributes(key)...)
+	err := t.tx.Get(key, dst)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) GetMulti(keys []*Key, dst []Entity) error {
+	s := t.start("GetMulti", attribute.Int("datastore.keys", len(keys)))
+	err := t.tx.GetMulti(keys, dst)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) Put(key *Key, src Entity) error {
+	s := t.start("Put", keyAttributes(key)...)
+	err := t.tx.Put(key, src)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) PutMulti(keys []*Key, src []Entity) error {
+	s := t.start("PutMulti", attribute.Int("datastore.keys", len(keys)))
+	err := t.tx.PutMulti(keys, src)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) Delete(key *Key) error {
+	s := t.start("Delete", keyAttributes(key)...)
+	err := t.tx.Delete(key)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) DeleteMulti(keys []*Key) error {
+	s := t.start("DeleteMulti", attribute.Int("datastore.keys", len(keys)))
+	err := t.tx.DeleteMulti(keys)
+	endSpan(s, err)
+	return err
+}
+
+func (t *tracingTransaction) start(op string, attrs ...attribute.KeyValue) trace.Span {
+	_, s := t.tracer.Start(t.ctx, "datastore."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return s
+}
+
+func (i *tracingIterator) Next(dst Entity) (*Key, error) {
+	k, err := i.it.Next(dst)
+	switch err {
+	case nil:
+		i.count++
+	case ErrIteratorDone:
+		i.end(nil)
+	default:
+		i.end(err)
+	}
+	return k, err
+}
+
+func (i *tracingIterator) Cursor() (string, error) {
+	c, err := i.it.Cursor()
+	i.end(err)
+	return c, err
+}
+
+// end ends the span of the query the first time it is called
+func (i *tracingIterator) end(err error) {
+	if i.ended {
+		return
+	}
+	i.ended = true
+	i.span.SetAttributes(attribute.Int("datastore.results", i.count))
+	endSpan(i.span, err)
+}
+
+// endSpan ends the span of a datastore call, recording the error if there
+// is one. A missing entity or the end of the results is an expected result
+// rather than an error.
+func endSpan(s trace.Span, err error) {
+	if isFailure(err) && err != ErrNoSuchEntity {
+		s.RecordError(err)
+		s.SetStatus(codes.Error, err.Error())
+	}
+	s.End()
+}
+
+func keyAttributes(key *Key) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("datastore.kind", key.Kind),
+		attribute.String("datastore.name", key.Name),
+	}
+}
@@ -0,0 +1,161 @@
+package dfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/context"
+)
+
+// tracedFileSystem returns a filesystem that records its spans
+func tracedFileSystem(driver Driver) (*FileSystem, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	fs := NewDriverFileSystem(context.Background(), driver, "", "", WithTracerProvider(tp))
+	return fs, exporter
+}
+
+// findSpan returns the last recorded span with the name
+func findSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func spanAttribute(s *tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing(t *testing.T) {
+	driver := NewMemoryDriver()
+	fs, exporter := tracedFileSystem(driver)
+
+	if err := afero.WriteFile(fs, "/posts/hello.md", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.GetSpans()
+
+	// the file is saved when it is closed
+	closeSpan := findSpan(spans, "dfs.Close")
+	if closeSpan == nil {
+		t.Fatal("no close span")
+	}
+	if v, _ := spanAttribute(closeSpan, "dfs.path"); v.AsString() != "/posts/hello.md" {
+		t.Errorf("path = %q", v.AsString())
+	}
+	tx := findSpan(spans, "datastore.RunInTransaction")
+	if tx == nil || tx.Parent.SpanID() != closeSpan.SpanContext.SpanID() {
+		t.Error("transaction isn't a child of close")
+	}
+	put := findSpan(spans, "datastore.Put")
+	if put == nil || put.Parent.SpanID() != tx.SpanContext.SpanID() {
+		t.Error("put isn't a child of the transaction")
+	}
+	write := findSpan(spans, "dfs.Write")
+	if v, _ := spanAttribute(write, "dfs.bytes"); v.AsInt64() != 5 {
+		t.Errorf("bytes written = %d, want 5", v.AsInt64())
+	}
+
+	exporter.Reset()
+	fs2 := NewDriverFileSystem(context.Background(), driver, "", "")
+	if _, err := afero.ReadFile(fs2, "/posts/hello.md"); err != nil {
+		t.Fatal(err)
+	}
+	if len(exporter.GetSpans()) != 0 {
+		t.Error("spans recorded without a tracer provider")
+	}
+
+	// a file loaded from datastore is a cache miss, then a hit
+	fs.cache.remove("/posts/hello.md")
+	for _, want := range []struct {
+		event string
+		gets  int
+	}{
+		{"dfs.cache.miss", 1},
+		{"dfs.cache.hit", 0},
+	} {
+		exporter.Reset()
+		if _, err := fs.Stat("/posts/hello.md"); err != nil {
+			t.Fatal(err)
+		}
+		spans := exporter.GetSpans()
+		stat := findSpan(spans, "dfs.Stat")
+		if stat == nil || len(stat.Events) != 1 || stat.Events[0].Name != want.event {
+			t.Errorf("stat events = %v, want %s", stat.Events, want.event)
+		}
+		gets := 0
+		for _, s := range spans {
+			if s.Name == "datastore.Get" {
+				gets++
+			}
+		}
+		if gets != want.gets {
+			t.Errorf("%d gets, want %d", gets, want.gets)
+		}
+	}
+
+	exporter.Reset()
+	f, err := fs.Open("/posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Readdir(-1); err != nil {
+		t.Fatal(err)
+	}
+	readdir := findSpan(exporter.GetSpans(), "dfs.Readdir")
+	if v, _ := spanAttribute(readdir, "dfs.entries"); v.AsInt64() != 1 {
+		t.Errorf("entries = %d, want 1", v.AsInt64())
+	}
+	run := findSpan(exporter.GetSpans(), "datastore.Run")
+	if run == nil || run.Parent.SpanID() != readdir.SpanContext.SpanID() {
+		t.Error("query isn't a child of readdir")
+	}
+	if v, _ := spanAttribute(run, "datastore.results"); v.AsInt64() != 1 {
+		t.Errorf("results = %d, want 1", v.AsInt64())
+	}
+}
+
+func TestTracingError(t *testing.T) {
+	fs, exporter := tracedFileSystem(NewMemoryDriver())
+
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("err = %v", err)
+	}
+	stat := findSpan(exporter.GetSpans(), "dfs.Stat")
+	if stat == nil || stat.Status.Description == "" || len(stat.Events) != 2 {
+		t.Errorf("stat span = %+v, want error recorded", stat)
+	}
+
+	// a missing entity isn't an error of the datastore call
+	get := findSpan(exporter.GetSpans(), "datastore.Get")
+	if get == nil || get.Status.Description != "" {
+		t.Errorf("get span = %+v", get)
+	}
+
+	// and nor is reading to the end of a file
+	if err := afero.WriteFile(fs, "/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter.Reset()
+	if _, err := afero.ReadFile(fs, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "dfs.Read" && (s.Status.Code == codes.Error || len(s.Events) != 0) {
+			t.Errorf("read span = %+v", s)
+		}
+	}
+}